@@ -0,0 +1,151 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+type (
+	// aggregator accumulates samples per series (key and type), for the Service implementations that send metrics
+	// per interval, rather than per call.
+	aggregator struct {
+		mutex  sync.Mutex
+		series map[aggregateKey]*aggregate
+		// values indicates that the values of histogram and timing samples should be retained.
+		values bool
+	}
+
+	aggregateKey struct {
+		key        string
+		metricType MetricType
+	}
+
+	aggregate struct {
+		Key  string
+		Info BucketInfo
+		Type MetricType
+		// Count is the number of samples.
+		Count int
+		Sum   float64
+		Min   float64
+		Max   float64
+		Last  float64
+		// Values is only populated for histograms and timings, if enabled.
+		Values  []float64
+		Uniques map[string]struct{}
+	}
+)
+
+// add accumulates a sample, returning false if the value was invalid, and therefore dropped.
+func (a *aggregator) add(sample Sample) bool {
+	var (
+		value  float64
+		unique string
+	)
+	if sample.Type == MetricUnique {
+		unique = fmt.Sprint(sample.Value)
+	} else {
+		var ok bool
+		if value, ok = sample.Float64(); !ok {
+			return false
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.series == nil {
+		a.series = make(map[aggregateKey]*aggregate)
+	}
+
+	k := aggregateKey{key: sample.Key, metricType: sample.Type}
+	series, ok := a.series[k]
+	if !ok {
+		series = &aggregate{
+			Key:  sample.Key,
+			Info: sample.Info,
+			Type: sample.Type,
+			Min:  value,
+			Max:  value,
+		}
+		a.series[k] = series
+	}
+
+	series.Count++
+
+	if sample.Type == MetricUnique {
+		if series.Uniques == nil {
+			series.Uniques = make(map[string]struct{})
+		}
+		series.Uniques[unique] = struct{}{}
+		return true
+	}
+
+	series.Sum += value
+	series.Min = math.Min(series.Min, value)
+	series.Max = math.Max(series.Max, value)
+	series.Last = value
+
+	if a.values && (sample.Type == MetricHistogram || sample.Type == MetricTiming) {
+		series.Values = append(series.Values, value)
+	}
+
+	return true
+}
+
+// flush returns and resets every aggregate, sorted by key then type.
+func (a *aggregator) flush() []*aggregate {
+	a.mutex.Lock()
+	series := a.series
+	a.series = nil
+	a.mutex.Unlock()
+
+	r := make([]*aggregate, 0, len(series))
+	for _, v := range series {
+		r = append(r, v)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Key != r[j].Key {
+			return r[i].Key < r[j].Key
+		}
+		return r[i].Type < r[j].Type
+	})
+	return r
+}
+
+// Value summarises the aggregate as a single value, the sum for counts, the last value for gauges, the number of
+// distinct values for uniques, and the mean for histograms and timings.
+func (a *aggregate) Value() float64 {
+	switch a.Type {
+	case MetricCount:
+		return a.Sum
+	case MetricUnique:
+		return float64(len(a.Uniques))
+	case MetricHistogram, MetricTiming:
+		if a.Count == 0 {
+			return 0
+		}
+		return a.Sum / float64(a.Count)
+	default:
+		return a.Last
+	}
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	a := aggregator{values: true}
+
+	for _, sample := range []Sample{
+		{Key: "b", Type: MetricCount, Value: 2},
+		{Key: "b", Type: MetricCount, Value: 3},
+		{Key: "b", Type: MetricGauge, Value: 5},
+		{Key: "b", Type: MetricGauge, Value: 4},
+		{Key: "a", Type: MetricHistogram, Value: 4},
+		{Key: "a", Type: MetricHistogram, Value: 1},
+		{Key: "a", Type: MetricHistogram, Value: 7},
+		{Key: "a", Type: MetricUnique, Value: "x"},
+		{Key: "a", Type: MetricUnique, Value: 1},
+		{Key: "a", Type: MetricUnique, Value: "x"},
+	} {
+		if !a.add(sample) {
+			t.Fatal(sample)
+		}
+	}
+
+	if a.add(Sample{Key: "a", Type: MetricGauge, Value: "x"}) {
+		t.Error("expected invalid")
+	}
+
+	series := a.flush()
+
+	if len(series) != 4 {
+		t.Fatal(len(series))
+	}
+
+	for i, expected := range []struct {
+		Key    string
+		Type   MetricType
+		Count  int
+		Min    float64
+		Max    float64
+		Value  float64
+		Values int
+	}{
+		{Key: "a", Type: MetricHistogram, Count: 3, Min: 1, Max: 7, Value: 4, Values: 3},
+		{Key: "a", Type: MetricUnique, Count: 3, Value: 2},
+		{Key: "b", Type: MetricCount, Count: 2, Min: 2, Max: 3, Value: 5},
+		{Key: "b", Type: MetricGauge, Count: 2, Min: 4, Max: 5, Value: 4},
+	} {
+		s := series[i]
+		if s.Key != expected.Key || s.Type != expected.Type || s.Count != expected.Count || s.Min != expected.Min ||
+			s.Max != expected.Max || s.Value() != expected.Value || len(s.Values) != expected.Values {
+			t.Error(i, *s)
+		}
+	}
+
+	if series := a.flush(); len(series) != 0 {
+		t.Error(series)
+	}
+
+	if v := (&aggregate{Type: MetricTiming}).Value(); v != 0 {
+		t.Error(v)
+	}
+}
@@ -62,6 +62,13 @@ type (
 		Timing(value interface{})
 	}
 
+	// Enabler is an optional interface, which may be implemented by a Service or Bucket, to indicate whether
+	// sending metrics will have any effect, e.g. false if the Service is a no-op, or the bucket key is invalid,
+	// allowing callers to skip computing expensive values or tags, see Enabled.
+	Enabler interface {
+		Enabled() bool
+	}
+
 	// StatsDClient matches the implementation provided by github.com/alexcesaro/statsd
 	StatsDClient interface {
 		Close()
@@ -74,6 +81,18 @@ type (
 		Unique(bucket string, value string)
 	}
 
+	// StatsDErrorClient is an optional extension of StatsDClient, which will be detected by the Service returned by
+	// NewStatsDService, allowing errors to propagate from Service.Flush and Service.Close, note that it is
+	// implemented by NewStatsDClient.
+	StatsDErrorClient interface {
+		StatsDClient
+		// FlushErr is equivalent to Flush, but returns any error, including any that occurred asynchronously, since
+		// the last call to Flush or FlushErr.
+		FlushErr() error
+		// CloseErr is equivalent to Close, but returns any error, see also FlushErr.
+		CloseErr() error
+	}
+
 	// BucketInfo provides a store for bucket and tag key-values where they all must be normalised to strings anyway.
 	BucketInfo struct {
 		Bucket string
@@ -88,8 +107,90 @@ type (
 	// Tagger models something that may apply additional tags to a Bucket, and is intended to be used to provide
 	// optional / generic tag / externally validated tag configuration, when implementing your own stats utilities.
 	Tagger func(bucket Bucket) (Bucket, error)
+
+	// MetricType identifies the kind of a metric, corresponding to the Bucket method used to send it, note that
+	// Bucket.Increment sends a MetricCount.
+	MetricType int
+
+	// TagValuesFunc resolves the (already sanitised) values of a single tag to the values that will actually be
+	// written by a key func built using NewBucketKeyFunc, each resulting value is written as a separate (repeated)
+	// tag, and empty values are omitted, returning ok as false will cause the key func to fail (return !ok).
+	TagValuesFunc func(values []string) (result []string, ok bool)
+
+	// BucketKeyOption configures the behavior of a key func built using NewBucketKeyFunc.
+	BucketKeyOption func(c *bucketKeyConfig)
+
+	// KeySanitisers provides a separate sanitiser for each part of a bucket key, see NewBucketKeyFuncSanitisers,
+	// as well as presets like DatadogKeySanitisers and InfluxKeySanitisers.
+	KeySanitisers struct {
+		Bucket   func(value string) string
+		TagKey   func(value string) string
+		TagValue func(value string) string
+	}
+
+	bucketKeyConfig struct {
+		tagValues TagValuesFunc
+	}
+
+	// bucketKeyFormat models the output format of key funcs built using newBucketKeyFunc, where each tag is written
+	// like first + key + assign + quote + value + quote, using next instead of first for subsequent tags, and last is
+	// written only if there were any tags.
+	bucketKeyFormat struct {
+		first, next, assign, quote, last string
+	}
+)
+
+const (
+	// MetricCount is sent by Bucket.Count and Bucket.Increment.
+	MetricCount MetricType = iota + 1
+	// MetricGauge is sent by Bucket.Gauge.
+	MetricGauge
+	// MetricHistogram is sent by Bucket.Histogram.
+	MetricHistogram
+	// MetricUnique is sent by Bucket.Unique.
+	MetricUnique
+	// MetricTiming is sent by Bucket.Timing.
+	MetricTiming
 )
 
+// String returns the lowercase name of the Bucket method, e.g. "count", or "unknown".
+func (t MetricType) String() string {
+	switch t {
+	case MetricCount:
+		return "count"
+	case MetricGauge:
+		return "gauge"
+	case MetricHistogram:
+		return "histogram"
+	case MetricUnique:
+		return "unique"
+	case MetricTiming:
+		return "timing"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, using String, note that it will return an error for an unknown
+// type.
+func (t MetricType) MarshalText() ([]byte, error) {
+	if s := t.String(); s != "unknown" {
+		return []byte(s), nil
+	}
+	return nil, fmt.Errorf("appstats.MetricType.MarshalText unknown type: %d", t)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the values returned by String, except "unknown".
+func (t *MetricType) UnmarshalText(text []byte) error {
+	for v := MetricCount; v <= MetricTiming; v++ {
+		if v.String() == string(text) {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("appstats.MetricType.UnmarshalText unknown type: %q", text)
+}
+
 // TagMapStringInterface returns a new Tagger that will apply all keys and values to a bucket.
 func TagMapStringInterface(m map[string]interface{}) Tagger {
 	return func(bucket Bucket) (Bucket, error) {
@@ -171,55 +272,231 @@ func DefaultBucketKeyFunc(info BucketInfo) (string, bool) {
 	return defaultBucketKeyFunc(info)
 }
 
-var defaultBucketKeyFunc = NewBucketKeyFunc(SanitiseKey)
+var (
+	defaultBucketKeyFunc = NewBucketKeyFunc(SanitiseKey)
+
+	influxBucketKeyFormat = bucketKeyFormat{
+		first:  ",",
+		next:   ",",
+		assign: "=",
+	}
+)
 
 // NewBucketKeyFunc provides the same implementation as DefaultBucketKeyFunc, but with the ability to specify a
-// custom key sanitiser, note that it will panic if keySanitiser is nil.
-func NewBucketKeyFunc(keySanitiser func(value string) string) BucketKeyFunc {
+// custom key sanitiser, and options such as BucketKeyTagValues, note that it will panic if keySanitiser is nil.
+func NewBucketKeyFunc(keySanitiser func(value string) string, opts ...BucketKeyOption) BucketKeyFunc {
 	if keySanitiser == nil {
 		panic(errors.New("appstats.NewBucketKeyFunc nil key sanitiser"))
 	}
 
+	return newBucketKeyFunc(
+		influxBucketKeyFormat,
+		KeySanitisers{
+			Bucket:   keySanitiser,
+			TagKey:   keySanitiser,
+			TagValue: keySanitiser,
+		},
+		opts...,
+	)
+}
+
+// NewBucketKeyFuncSanitisers is like NewBucketKeyFunc, but accepts a separate sanitiser for the bucket, tag keys,
+// and tag values, e.g. allowing tag values to start with a number, note that it will panic if any are nil.
+func NewBucketKeyFuncSanitisers(sanitisers KeySanitisers, opts ...BucketKeyOption) BucketKeyFunc {
+	if sanitisers.Bucket == nil || sanitisers.TagKey == nil || sanitisers.TagValue == nil {
+		panic(errors.New("appstats.NewBucketKeyFuncSanitisers nil sanitiser"))
+	}
+
+	return newBucketKeyFunc(influxBucketKeyFormat, sanitisers, opts...)
+}
+
+// DatadogKeySanitisers returns sanitisers following datadog's best practices, using SanitiseKey for the bucket and
+// tag keys, and SanitiseTagValue for tag values, which unlike the default behavior preserves values like "200".
+func DatadogKeySanitisers() KeySanitisers {
+	return KeySanitisers{
+		Bucket:   SanitiseKey,
+		TagKey:   SanitiseKey,
+		TagValue: SanitiseTagValue,
+	}
+}
+
+func newBucketKeyFunc(format bucketKeyFormat, sanitisers KeySanitisers, opts ...BucketKeyOption) BucketKeyFunc {
+	c := newBucketKeyConfig(opts...)
+
 	return func(info BucketInfo) (name string, ok bool) {
-		bucket := bytes.NewBufferString(keySanitiser(info.Bucket))
+		bucket := bytes.NewBufferString(sanitisers.Bucket(info.Bucket))
 
 		if bucket.Len() == 0 {
 			return "", false
 		}
 
-		tags := make(sortStringsBytesCompare, 0, len(info.Tags))
-		values := make(map[string][]string)
-
-		for tag, tagValues := range info.Tags {
-			tag = keySanitiser(tag)
+		tags, values, ok := c.tags(info, sanitisers)
+		if !ok {
+			return "", false
+		}
 
-			if tag == "" {
-				continue
+		for i, tag := range tags {
+			for j, value := range values[tag] {
+				if i == 0 && j == 0 {
+					bucket.WriteString(format.first)
+				} else {
+					bucket.WriteString(format.next)
+				}
+				bucket.WriteString(tag)
+				bucket.WriteString(format.assign)
+				bucket.WriteString(format.quote)
+				bucket.WriteString(value)
+				bucket.WriteString(format.quote)
 			}
+		}
+
+		if len(tags) != 0 {
+			bucket.WriteString(format.last)
+		}
+
+		return bucket.String(), true
+	}
+}
 
-			if _, ok := values[tag]; !ok {
-				tags = append(tags, tag)
-				values[tag] = nil
+func newBucketKeyConfig(opts ...BucketKeyOption) bucketKeyConfig {
+	c := bucketKeyConfig{
+		tagValues: TagValuesLast,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&c)
+		}
+	}
+	return c
+}
+
+// tags returns the sanitised tag keys, sorted, that have at least one value, and the sanitised values to write for
+// each, as resolved by the TagValuesFunc, with any empty values removed, note that ok will be false only if the
+// TagValuesFunc failed.
+func (c bucketKeyConfig) tags(info BucketInfo, sanitisers KeySanitisers) (sortStringsBytesCompare, map[string][]string, bool) {
+	tags := make(sortStringsBytesCompare, 0, len(info.Tags))
+	values := make(map[string][]string)
+
+	for tag, tagValues := range info.Tags {
+		tag = sanitisers.TagKey(tag)
+
+		if tag == "" {
+			continue
+		}
+
+		if _, ok := values[tag]; !ok {
+			tags = append(tags, tag)
+			values[tag] = nil
+		}
+
+		values[tag] = append(values[tag], tagValues...)
+	}
+
+	sort.Sort(tags)
+
+	n := 0
+
+	for _, tag := range tags {
+		tagValues := make([]string, len(values[tag]))
+		for i, value := range values[tag] {
+			tagValues[i] = sanitisers.TagValue(value)
+		}
+
+		tagValues, ok := c.tagValues(tagValues)
+		if !ok {
+			return nil, nil, false
+		}
+
+		nonEmpty := make([]string, 0, len(tagValues))
+		for _, value := range tagValues {
+			if value != "" {
+				nonEmpty = append(nonEmpty, value)
 			}
+		}
+
+		if len(nonEmpty) == 0 {
+			delete(values, tag)
+			continue
+		}
+
+		values[tag] = nonEmpty
+		tags[n] = tag
+		n++
+	}
+
+	return tags[:n], values, true
+}
 
-			values[tag] = append(values[tag], tagValues...)
+// BucketKeyTagValues returns an option to configure how a key func built using NewBucketKeyFunc handles tags with
+// multiple values, see TagValuesFunc, note that a nil tagValues will use the default, TagValuesLast.
+func BucketKeyTagValues(tagValues TagValuesFunc) BucketKeyOption {
+	return func(c *bucketKeyConfig) {
+		if tagValues == nil {
+			tagValues = TagValuesLast
 		}
+		c.tagValues = tagValues
+	}
+}
 
-		sort.Sort(tags)
+// TagValuesLast is a TagValuesFunc that writes only the last value, BEFORE filtering empty values, and is the
+// default behavior.
+func TagValuesLast(values []string) ([]string, bool) {
+	if len(values) == 0 {
+		return nil, true
+	}
+	return values[len(values)-1:], true
+}
 
-		for _, tag := range tags {
-			if numValues := len(values[tag]); numValues > 0 {
-				if value := keySanitiser(values[tag][numValues-1]); value != "" {
-					bucket.WriteRune(',')
-					bucket.WriteString(tag)
-					bucket.WriteRune('=')
-					bucket.WriteString(value)
-				}
+// TagValuesFirst is a TagValuesFunc that writes only the first value, BEFORE filtering empty values.
+func TagValuesFirst(values []string) ([]string, bool) {
+	if len(values) == 0 {
+		return nil, true
+	}
+	return values[:1], true
+}
+
+// TagValuesAll is a TagValuesFunc that writes every value as a repeated tag, e.g. "bucket,tag=a,tag=b", which is
+// valid for DogStatsD but not for InfluxDB.
+func TagValuesAll(values []string) ([]string, bool) {
+	return values, true
+}
+
+// TagValuesSingle is a TagValuesFunc that will fail the key func if there is more than one value for a tag.
+func TagValuesSingle(values []string) ([]string, bool) {
+	if len(values) > 1 {
+		return nil, false
+	}
+	return values, true
+}
+
+// TagValuesJoin returns a TagValuesFunc that writes a single value, all non-empty values joined by sep, note that
+// sep is not sanitised.
+func TagValuesJoin(sep string) TagValuesFunc {
+	return func(values []string) ([]string, bool) {
+		joined := make([]string, 0, len(values))
+		for _, value := range values {
+			if value != "" {
+				joined = append(joined, value)
 			}
 		}
+		if len(joined) == 0 {
+			return nil, true
+		}
+		return []string{strings.Join(joined, sep)}, true
+	}
+}
 
-		return bucket.String(), true
+// Enabled returns false if v (e.g. a Service or Bucket) is nil, or implements Enabler, and Enabled returns false,
+// and true otherwise, and is intended to allow instrumentation to bail out early, note that a Bucket may still be
+// enabled, even if its Service is not, as not all implementations are aware of their Service.
+func Enabled(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if enabler, ok := v.(Enabler); ok {
+		return enabler.Enabled()
 	}
+	return true
 }
 
 // NewStatsDService wraps https://github.com/alexcesaro/statsd, note both args may be nil, defaults will be used.
@@ -241,21 +518,26 @@ func NewStatsDService(
 
 // Tag values to a key (or just ensures the key exists, if there are no values), note that the returned value will
 // not modify the value of the source but MAY NOT be a complete deep copy.
+// Each call copies the Tags map, meaning a chain of n calls is O(n^2), which is deliberate, as Tags is an exported,
+// mutable map, that callers may modify directly, so it can't safely share any persistent structure with the source,
+// unlike the Bucket implementations in this package, which share tags between derived buckets, and only materialise
+// a BucketInfo when necessary, and should be preferred when building up many tags.
 func (b *BucketInfo) Tag(key interface{}, values ...interface{}) *BucketInfo {
 	keyStr := fmt.Sprint(key)
 
-	r := &BucketInfo{
-		Tags: map[string][]string{
-			keyStr: nil,
-		},
-	}
+	var tags map[string][]string
+
+	r := new(BucketInfo)
 
 	if b != nil {
 		r.Bucket = b.Bucket
+		tags = b.Tags
+	}
 
-		for k, v := range b.Tags {
-			r.Tags[k] = v
-		}
+	r.Tags = make(map[string][]string, len(tags)+1)
+
+	for k, v := range tags {
+		r.Tags[k] = v
 	}
 
 	vn := make([]string, 0, len(r.Tags[keyStr])+len(values))
@@ -273,43 +555,16 @@ func (b *BucketInfo) Tag(key interface{}, values ...interface{}) *BucketInfo {
 
 // SanitiseKey sanitises a string key according to the best practice for tags provided by datadog, see
 // https://docs.datadoghq.com/getting_started/tagging/#tags-best-practices
+// It is implemented using NewSanitiser, lowercasing, requiring a leading letter, allowing letters, numbers, and any
+// of `_-:./\`, replacing any other runes with '_', limiting the length to 200 bytes, and trimming trailing colons.
 func SanitiseKey(value string) string {
-	b := new(bytes.Buffer)
-
-	for _, r := range []rune(value) {
-		if b.Len() >= 200 {
-			break
-		}
-
-		r = unicode.ToLower(r)
-
-		if b.Len() == 0 {
-			if unicode.IsLetter(r) {
-				b.WriteRune(r)
-			}
-			continue
-		}
-
-		if unicode.IsLetter(r) ||
-			unicode.IsNumber(r) ||
-			r == '_' ||
-			r == '-' ||
-			r == ':' ||
-			r == '.' ||
-			r == '/' ||
-			r == '\\' {
-			b.WriteRune(r)
-			continue
-		}
-
-		b.WriteRune('_')
-	}
-
-	for runes := []rune(b.String()); b.Len() > 200 || (len(runes) > 0 && runes[len(runes)-1] == ':'); runes = []rune(b.String()) {
-		b.Truncate(b.Len() - len([]byte(string([]rune{runes[len(runes)-1]}))))
-	}
+	return datadogSanitiser(value)
+}
 
-	return b.String()
+// SanitiseTagValue is like SanitiseKey, but for tag values, which may start with any allowed rune, e.g. "2xx", note
+// that trailing colons are still trimmed, as a tag must not end with one.
+func SanitiseTagValue(value string) string {
+	return datadogTagValueSanitiser(value)
 }
 
 // TimingToDuration attempts to convert a value to a duration to be used in timing calls, normalising various data
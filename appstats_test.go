@@ -937,6 +937,137 @@ func TestNewBucketKeyFunc_nil(t *testing.T) {
 	t.Error("should not reach here")
 }
 
+func TestNewBucketKeyFunc_tagValues(t *testing.T) {
+	info := BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"a": {"one", "123", "Two"},
+			"b": {"three"},
+			"c": nil,
+		},
+	}
+
+	testCases := []struct {
+		TagValues TagValuesFunc
+		Key       string
+		Ok        bool
+	}{
+		{
+			TagValues: nil,
+			Key:       "bucket,a=two,b=three",
+			Ok:        true,
+		},
+		{
+			TagValues: TagValuesLast,
+			Key:       "bucket,a=two,b=three",
+			Ok:        true,
+		},
+		{
+			TagValues: TagValuesFirst,
+			Key:       "bucket,a=one,b=three",
+			Ok:        true,
+		},
+		{
+			TagValues: TagValuesAll,
+			Key:       "bucket,a=one,a=two,b=three",
+			Ok:        true,
+		},
+		{
+			TagValues: TagValuesJoin("|"),
+			Key:       "bucket,a=one|two,b=three",
+			Ok:        true,
+		},
+		{
+			TagValues: TagValuesSingle,
+			Key:       "",
+			Ok:        false,
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewBucketKeyFunc_tagValues_#%d", i+1)
+
+		var opts []BucketKeyOption
+		if testCase.TagValues != nil {
+			opts = append(opts, BucketKeyTagValues(testCase.TagValues))
+		}
+
+		key, ok := NewBucketKeyFunc(SanitiseKey, opts...)(info)
+
+		if key != testCase.Key {
+			t.Error(name, "key", "expected =", testCase.Key, "actual =", key)
+		}
+
+		if ok != testCase.Ok {
+			t.Error(name, "ok", "expected =", testCase.Ok, "actual =", ok)
+		}
+	}
+}
+
+func TestTagValuesSingle(t *testing.T) {
+	key, ok := NewBucketKeyFunc(SanitiseKey, BucketKeyTagValues(TagValuesSingle))(BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"a": {"one"},
+			"b": nil,
+		},
+	})
+	if key != "bucket,a=one" || !ok {
+		t.Error(key, ok)
+	}
+}
+
+func TestNewBucketKeyFuncSanitisers(t *testing.T) {
+	keyFunc := NewBucketKeyFuncSanitisers(KeySanitisers{
+		Bucket: func(value string) string {
+			return "b_" + value
+		},
+		TagKey: func(value string) string {
+			return "k_" + value
+		},
+		TagValue: func(value string) string {
+			return "v_" + value
+		},
+	})
+	if key, ok := keyFunc(BucketInfo{Bucket: "1", Tags: map[string][]string{"2": {"3"}}}); key != "b_1,k_2=v_3" || !ok {
+		t.Error(key, ok)
+	}
+}
+
+func TestNewBucketKeyFuncSanitisers_nil(t *testing.T) {
+	for _, sanitisers := range []KeySanitisers{
+		{},
+		{TagKey: SanitiseKey, TagValue: SanitiseKey},
+		{Bucket: SanitiseKey, TagValue: SanitiseKey},
+		{Bucket: SanitiseKey, TagKey: SanitiseKey},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || fmt.Sprint(r) != "appstats.NewBucketKeyFuncSanitisers nil sanitiser" {
+					t.Error(r)
+				}
+			}()
+			NewBucketKeyFuncSanitisers(sanitisers)
+			t.Error("should not reach here")
+		}()
+	}
+}
+
+func TestDatadogKeySanitisers(t *testing.T) {
+	key, ok := NewBucketKeyFuncSanitisers(DatadogKeySanitisers())(BucketInfo{
+		Bucket: "Requests",
+		Tags: map[string][]string{
+			"123":    {"abc"},
+			"Status": {"200"},
+			"Class":  {"2XX"},
+			"Region": {"us-east-1:"},
+		},
+	})
+	if key != "requests,class=2xx,region=us-east-1,status=200" || !ok {
+		t.Error(key, ok)
+	}
+}
+
 func benchmarkTimingToDuration(b *testing.B, fn func(value interface{}, multi time.Duration) (d time.Duration, ok bool)) {
 	for n := 0; n < b.N; n++ {
 		b.StopTimer()
@@ -963,3 +1094,57 @@ func benchmarkTimingToDuration(b *testing.B, fn func(value interface{}, multi ti
 func BenchmarkTimingToDuration(b *testing.B) {
 	benchmarkTimingToDuration(b, TimingToDuration)
 }
+
+func TestMetricType_String(t *testing.T) {
+	for metricType, expected := range map[MetricType]string{
+		0:                "unknown",
+		MetricCount:      "count",
+		MetricGauge:      "gauge",
+		MetricHistogram:  "histogram",
+		MetricUnique:     "unique",
+		MetricTiming:     "timing",
+		MetricTiming + 1: "unknown",
+	} {
+		if actual := metricType.String(); actual != expected {
+			t.Error(int(metricType), expected, actual)
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	if Enabled(nil) {
+		t.Error("expected disabled")
+	}
+	if !Enabled(struct{}{}) {
+		t.Error("expected enabled")
+	}
+	if Enabled(mockEnabler(false)) || !Enabled(mockEnabler(true)) {
+		t.Error("unexpected result")
+	}
+}
+
+type mockEnabler bool
+
+func (m mockEnabler) Enabled() bool {
+	return bool(m)
+}
+
+func TestMetricType_text(t *testing.T) {
+	for v := MetricCount; v <= MetricTiming; v++ {
+		b, err := v.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r MetricType
+		if err := r.UnmarshalText(b); err != nil || r != v {
+			t.Error(v, r, err)
+		}
+	}
+	if _, err := MetricType(0).MarshalText(); err == nil || err.Error() != "appstats.MetricType.MarshalText unknown type: 0" {
+		t.Error(err)
+	}
+	var r MetricType
+	if err := r.UnmarshalText([]byte("unknown")); err == nil || err.Error() != `appstats.MetricType.UnmarshalText unknown type: "unknown"` {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// Sample models a single metric sent using a Bucket created by NewBucket.
+	Sample struct {
+		// Key is the bucket key, as generated by the key func, and will never be empty.
+		Key string
+		// Info is the bucket and tags, which is shared, and MUST NOT be modified.
+		Info BucketInfo
+		// Type identifies the Bucket method that was called.
+		Type MetricType
+		// Value is the value exactly as it was provided, or 1 for Bucket.Increment.
+		Value interface{}
+	}
+
+	sinkBucket struct {
+		keyFunc BucketKeyFunc
+		sink    func(sample Sample)
+		bucket  *bucketState
+	}
+
+	// bucketState is an immutable bucket name and set of tags, used by the Bucket implementations in this package,
+	// which materialises the equivalent BucketInfo (and bucket key) lazily, at most once.
+	bucketState struct {
+		name     string
+		tags     *tagList
+		infoOnce sync.Once
+		info     BucketInfo
+		keyOnce  sync.Once
+		key      string
+		keyOk    bool
+	}
+
+	// tagList is an immutable, persistent list of tag operations, newest first, which allows buckets derived from a
+	// common parent to share storage, making each Tag call O(len(values)) rather than O(total tags).
+	tagList struct {
+		next   *tagList
+		key    string
+		values []string
+		length int
+	}
+)
+
+// NewBucket returns a Bucket that passes every metric to sink, as a Sample, and is intended to simplify implementing
+// a Service, note that keyFunc may be nil, in which case DefaultBucketKeyFunc will be used, any metrics for which the
+// key func returns an empty key or !ok will be dropped, and that it will panic if sink is nil.
+// The bucket key and BucketInfo are generated lazily, at most once per bucket, and tags are shared with derived
+// buckets, rather than copied.
+func NewBucket(bucket interface{}, keyFunc BucketKeyFunc, sink func(sample Sample)) Bucket {
+	if sink == nil {
+		panic(errors.New("appstats.NewBucket nil sink"))
+	}
+	if keyFunc == nil {
+		keyFunc = DefaultBucketKeyFunc
+	}
+	return sinkBucket{
+		keyFunc: keyFunc,
+		sink:    sink,
+		bucket:  newBucketState(bucket),
+	}
+}
+
+// Tag returns a bucket with the tag and possibly values appended, string formatting all args with `%v`, note that
+// this WILL NOT modify the original bucket.
+func (b sinkBucket) Tag(key interface{}, values ...interface{}) Bucket {
+	b.bucket = b.bucket.tag(key, values...)
+	return b
+}
+
+// Enabled returns false if the key func returns an empty key or !ok, meaning every metric would be dropped.
+func (b sinkBucket) Enabled() bool {
+	key, ok := b.bucket.bucketKey(b.keyFunc)
+	return ok && key != ""
+}
+
+// Count sends a MetricCount sample.
+func (b sinkBucket) Count(n interface{}) {
+	b.send(MetricCount, n)
+}
+
+// Increment sends a MetricCount sample, with the value 1.
+func (b sinkBucket) Increment() {
+	b.send(MetricCount, 1)
+}
+
+// Gauge sends a MetricGauge sample.
+func (b sinkBucket) Gauge(value interface{}) {
+	b.send(MetricGauge, value)
+}
+
+// Histogram sends a MetricHistogram sample.
+func (b sinkBucket) Histogram(value interface{}) {
+	b.send(MetricHistogram, value)
+}
+
+// Unique sends a MetricUnique sample.
+func (b sinkBucket) Unique(value interface{}) {
+	b.send(MetricUnique, value)
+}
+
+// Timing sends a MetricTiming sample.
+func (b sinkBucket) Timing(value interface{}) {
+	b.send(MetricTiming, value)
+}
+
+// Float64 converts Value to a float64, supporting any type that formats as a number, with timings converted to
+// milliseconds using TimingToDuration, where numbers are nanoseconds, consistent with the StatsD implementation,
+// note that NaN and infinite values are not supported.
+func (s Sample) Float64() (float64, bool) {
+	if s.Type == MetricTiming {
+		d, ok := TimingToDuration(s.Value, time.Nanosecond)
+		if !ok {
+			return 0, false
+		}
+		return float64(d) / float64(time.Millisecond), true
+	}
+	switch value := s.Value.(type) {
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, false
+		}
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	}
+	r, ok := stringToRat(fmt.Sprint(s.Value))
+	if !ok {
+		return 0, false
+	}
+	f, _ := r.Float64()
+	return f, true
+}
+
+func (b sinkBucket) send(metricType MetricType, value interface{}) {
+	if key, ok := b.bucket.bucketKey(b.keyFunc); ok && key != "" {
+		b.sink(Sample{
+			Key:   key,
+			Info:  b.bucket.Info(),
+			Type:  metricType,
+			Value: value,
+		})
+	}
+}
+
+// applyBucketTags returns bucket with the tags of info applied, in order of key, used to re-create a bucket for a
+// different Service.
+func applyBucketTags(bucket Bucket, info BucketInfo) Bucket {
+	for _, key := range info.sortedTagKeys() {
+		values := make([]interface{}, len(info.Tags[key]))
+		for i, v := range info.Tags[key] {
+			values[i] = v
+		}
+		bucket = bucket.Tag(key, values...)
+	}
+	return bucket
+}
+
+func newBucketState(bucket interface{}) *bucketState {
+	return &bucketState{
+		name: fmt.Sprint(bucket),
+	}
+}
+
+// tag returns a new bucketState with the tag appended, string formatting all args with `%v`.
+func (s *bucketState) tag(key interface{}, values ...interface{}) *bucketState {
+	return &bucketState{
+		name: s.name,
+		tags: s.tags.tag(key, values...),
+	}
+}
+
+// Info returns the materialised BucketInfo, which is shared, and MUST NOT be modified.
+func (s *bucketState) Info() BucketInfo {
+	s.infoOnce.Do(func() {
+		s.info = s.tags.info(s.name)
+	})
+	return s.info
+}
+
+// bucketKey returns the result of keyFunc for Info, note that only the first keyFunc is ever called, as the
+// result is cached, and the Bucket implementations using bucketState always use the same one.
+func (s *bucketState) bucketKey(keyFunc BucketKeyFunc) (string, bool) {
+	s.keyOnce.Do(func() {
+		s.key, s.keyOk = keyFunc(s.Info())
+	})
+	return s.key, s.keyOk
+}
+
+func (l *tagList) tag(key interface{}, values ...interface{}) *tagList {
+	r := &tagList{
+		next: l,
+		key:  fmt.Sprint(key),
+	}
+	if len(values) != 0 {
+		r.values = make([]string, len(values))
+		for i, v := range values {
+			r.values[i] = fmt.Sprint(v)
+		}
+	}
+	if l != nil {
+		r.length = l.length
+	}
+	r.length++
+	return r
+}
+
+// info materialises a BucketInfo equivalent to applying every tag operation, oldest first, via BucketInfo.Tag.
+func (l *tagList) info(bucket string) BucketInfo {
+	r := BucketInfo{
+		Bucket: bucket,
+	}
+	if l == nil {
+		return r
+	}
+	nodes := make([]*tagList, l.length)
+	for i := len(nodes) - 1; l != nil && i >= 0; l, i = l.next, i-1 {
+		nodes[i] = l
+	}
+	r.Tags = make(map[string][]string, len(nodes))
+	for _, node := range nodes {
+		values, ok := r.Tags[node.key]
+		if !ok {
+			values = make([]string, 0, len(node.values))
+		}
+		r.Tags[node.key] = append(values, node.values...)
+	}
+	return r
+}
@@ -0,0 +1,287 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"github.com/go-test/deep"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTagList_info_matchesBucketInfoTag(t *testing.T) {
+	type op struct {
+		Key    interface{}
+		Values []interface{}
+	}
+
+	ops := []op{
+		{Key: "a"},
+		{Key: "b", Values: []interface{}{1, "2"}},
+		{Key: "a", Values: []interface{}{true}},
+		{Key: 4},
+		{Key: "b"},
+		{Key: "b", Values: []interface{}{nil}},
+		{Key: 4},
+	}
+
+	var (
+		expected = &BucketInfo{Bucket: "bucket"}
+		state    = newBucketState("bucket")
+	)
+
+	for i, op := range ops {
+		expected = expected.Tag(op.Key, op.Values...)
+		state = state.tag(op.Key, op.Values...)
+
+		if diff := deep.Equal(state.Info(), *expected); diff != nil {
+			t.Fatal(i, diff)
+		}
+	}
+}
+
+func TestTagList_info_empty(t *testing.T) {
+	if diff := deep.Equal(newBucketState(nil).Info(), BucketInfo{Bucket: "<nil>"}); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestBucketState_tag_shared(t *testing.T) {
+	parent := newBucketState("bucket").tag("a", 1)
+	one := parent.tag("b", 2)
+	two := parent.tag("a", 3)
+
+	if one.tags.next != parent.tags || two.tags.next != parent.tags {
+		t.Fatal("expected shared tags")
+	}
+
+	if diff := deep.Equal(parent.Info(), BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"a": {"1"},
+		},
+	}); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(one.Info(), BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"a": {"1"},
+			"b": {"2"},
+		},
+	}); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(two.Info(), BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"a": {"1", "3"},
+		},
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestBucketState_bucketKey_cached(t *testing.T) {
+	var calls int
+	keyFunc := func(info BucketInfo) (string, bool) {
+		calls++
+		return info.Bucket, true
+	}
+	state := newBucketState("bucket")
+	for i := 0; i < 3; i++ {
+		if key, ok := state.bucketKey(keyFunc); key != "bucket" || !ok {
+			t.Fatal(key, ok)
+		}
+	}
+	if calls != 1 {
+		t.Error(calls)
+	}
+}
+
+func benchmarkTagChain(b *testing.B, n int, tag func(i int)) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for x := 0; x < b.N; x++ {
+		for i := 0; i < n; i++ {
+			tag(i)
+		}
+	}
+}
+
+func BenchmarkBucketInfo_Tag_8(b *testing.B) {
+	benchmarkBucketInfoTag(b, 8)
+}
+
+func BenchmarkBucketInfo_Tag_64(b *testing.B) {
+	benchmarkBucketInfoTag(b, 64)
+}
+
+func benchmarkBucketInfoTag(b *testing.B, n int) {
+	var info *BucketInfo
+	benchmarkTagChain(b, n, func(i int) {
+		if i == 0 {
+			info = &BucketInfo{Bucket: "bucket"}
+		}
+		info = info.Tag(i, "value")
+	})
+}
+
+func BenchmarkStatsDBucket_Tag_8(b *testing.B) {
+	benchmarkStatsDBucketTag(b, 8)
+}
+
+func BenchmarkStatsDBucket_Tag_64(b *testing.B) {
+	benchmarkStatsDBucketTag(b, 64)
+}
+
+func benchmarkStatsDBucketTag(b *testing.B, n int) {
+	var (
+		service = NewStatsDService(nil, nil)
+		bucket  Bucket
+	)
+	benchmarkTagChain(b, n, func(i int) {
+		if i == 0 {
+			bucket = service.Bucket("bucket")
+		}
+		bucket = bucket.Tag(i, "value")
+		if i == n-1 {
+			bucket.Increment()
+		}
+	})
+}
+
+func TestNewBucket(t *testing.T) {
+	var samples []Sample
+
+	bucket := NewBucket("bucket", nil, func(sample Sample) {
+		samples = append(samples, sample)
+	})
+
+	bucket.Count(2)
+	bucket = bucket.Tag("tag", "A")
+	bucket.Increment()
+	bucket.Gauge(3)
+	bucket.Histogram(4)
+	bucket.Unique("5")
+	bucket.Timing(6)
+	bucket.Tag("tag!", "123").Tag("").Count(7)
+
+	info := BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"tag": {"A"},
+		},
+	}
+
+	if diff := deep.Equal(samples, []Sample{
+		{Key: "bucket", Info: BucketInfo{Bucket: "bucket"}, Type: MetricCount, Value: 2},
+		{Key: "bucket,tag=a", Info: info, Type: MetricCount, Value: 1},
+		{Key: "bucket,tag=a", Info: info, Type: MetricGauge, Value: 3},
+		{Key: "bucket,tag=a", Info: info, Type: MetricHistogram, Value: 4},
+		{Key: "bucket,tag=a", Info: info, Type: MetricUnique, Value: "5"},
+		{Key: "bucket,tag=a", Info: info, Type: MetricTiming, Value: 6},
+		{
+			Key: "bucket,tag=a",
+			Info: BucketInfo{
+				Bucket: "bucket",
+				Tags: map[string][]string{
+					"tag":  {"A"},
+					"tag!": {"123"},
+					"":     {},
+				},
+			},
+			Type:  MetricCount,
+			Value: 7,
+		},
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestNewBucket_dropped(t *testing.T) {
+	bucket := NewBucket(nil, func(info BucketInfo) (string, bool) {
+		return info.Bucket, false
+	}, func(sample Sample) {
+		t.Error(sample)
+	})
+	bucket.Tag("a").Count(1)
+	NewBucket("", func(info BucketInfo) (string, bool) {
+		return "", true
+	}, func(sample Sample) {
+		t.Error(sample)
+	}).Count(1)
+}
+
+func TestSinkBucket_Enabled(t *testing.T) {
+	keyFunc := func(info BucketInfo) (string, bool) {
+		return info.Bucket, info.Tags["invalid"] == nil
+	}
+	sink := func(sample Sample) {}
+	if !Enabled(NewBucket("a", keyFunc, sink)) {
+		t.Error("expected enabled")
+	}
+	if Enabled(NewBucket("a", keyFunc, sink).Tag("invalid", 1)) {
+		t.Error("expected disabled")
+	}
+	if Enabled(NewBucket("", keyFunc, sink)) {
+		t.Error("expected disabled")
+	}
+}
+
+func TestNewBucket_nilSink(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || fmt.Sprint(r) != "appstats.NewBucket nil sink" {
+			t.Error(r)
+		}
+	}()
+	NewBucket(nil, nil, nil)
+}
+
+func TestSample_Float64(t *testing.T) {
+	testCases := []struct {
+		Sample Sample
+		Value  float64
+		Ok     bool
+	}{
+		{Sample: Sample{Type: MetricGauge, Value: 1.5}, Value: 1.5, Ok: true},
+		{Sample: Sample{Type: MetricGauge, Value: math.NaN()}, Ok: false},
+		{Sample: Sample{Type: MetricGauge, Value: math.Inf(-1)}, Ok: false},
+		{Sample: Sample{Type: MetricCount, Value: 3}, Value: 3, Ok: true},
+		{Sample: Sample{Type: MetricCount, Value: int64(-3)}, Value: -3, Ok: true},
+		{Sample: Sample{Type: MetricCount, Value: uint8(7)}, Value: 7, Ok: true},
+		{Sample: Sample{Type: MetricHistogram, Value: " 1,000.25 "}, Value: 1000.25, Ok: true},
+		{Sample: Sample{Type: MetricHistogram, Value: "nope"}, Ok: false},
+		{Sample: Sample{Type: MetricTiming, Value: time.Millisecond * 1500}, Value: 1500, Ok: true},
+		{Sample: Sample{Type: MetricTiming, Value: 2500000}, Value: 2.5, Ok: true},
+		{Sample: Sample{Type: MetricTiming, Value: "nope"}, Ok: false},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSample_Float64_#%d", i+1)
+
+		value, ok := testCase.Sample.Float64()
+
+		if value != testCase.Value || ok != testCase.Ok {
+			t.Error(name, "expected =", testCase.Value, testCase.Ok, "actual =", value, ok)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Equal returns true if other has the same bucket, and the same tags, with the same values in the same order, note
+// that nil and empty tags (or values) are considered equal.
+func (b BucketInfo) Equal(other BucketInfo) bool {
+	if b.Bucket != other.Bucket || len(b.Tags) != len(other.Tags) {
+		return false
+	}
+	for key, values := range b.Tags {
+		otherValues, ok := other.Tags[key]
+		if !ok || len(values) != len(otherValues) {
+			return false
+		}
+		for i := range values {
+			if values[i] != otherValues[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Hash returns a stable 64-bit FNV-1a hash, which is consistent with Equal, and independent of map order, and is
+// therefore suitable as a cheap, deterministic series identity, which won't change between processes.
+func (b BucketInfo) Hash() uint64 {
+	var (
+		h      = fnv.New64a()
+		buffer [binary.MaxVarintLen64]byte
+	)
+	write := func(s string) {
+		h.Write(buffer[:binary.PutUvarint(buffer[:], uint64(len(s)))])
+		h.Write([]byte(s))
+	}
+	write(b.Bucket)
+	for _, key := range b.sortedTagKeys() {
+		write(key)
+		h.Write(buffer[:binary.PutUvarint(buffer[:], uint64(len(b.Tags[key])))])
+		for _, value := range b.Tags[key] {
+			write(value)
+		}
+	}
+	return h.Sum64()
+}
+
+// MarshalText encodes a canonical form like "bucket,a=1,a=2,b", in the format supported by ParseBucketKey, with tags
+// sorted by key, values in order, and a backslash escaping any special characters.
+func (b BucketInfo) MarshalText() ([]byte, error) {
+	var s strings.Builder
+	s.WriteString(escape(b.Bucket, ","))
+	for _, key := range b.sortedTagKeys() {
+		key, values := escape(key, ",="), b.Tags[key]
+		if len(values) == 0 {
+			s.WriteByte(',')
+			s.WriteString(key)
+			continue
+		}
+		for _, value := range values {
+			s.WriteByte(',')
+			s.WriteString(key)
+			s.WriteByte('=')
+			s.WriteString(escape(value, ","))
+		}
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes the format generated by MarshalText.
+func (b *BucketInfo) UnmarshalText(text []byte) error {
+	info, err := parseEscapedBucketKey(string(text), false)
+	if err != nil {
+		return fmt.Errorf("appstats.BucketInfo.UnmarshalText %s", err.Error())
+	}
+	*b = info
+	return nil
+}
+
+// MarshalJSON encodes a canonical form like `{"Bucket":"bucket","Tags":{"a":["1","2"],"b":[]}}`, with tags sorted
+// by key, and where nil tags or values are encoded as empty.
+func (b BucketInfo) MarshalJSON() ([]byte, error) {
+	tags := make(map[string][]string, len(b.Tags))
+	for key, values := range b.Tags {
+		if values == nil {
+			values = []string{}
+		}
+		tags[key] = values
+	}
+	return json.Marshal(jsonBucketInfo{
+		Bucket: b.Bucket,
+		Tags:   tags,
+	})
+}
+
+// UnmarshalJSON decodes the format generated by MarshalJSON.
+func (b *BucketInfo) UnmarshalJSON(data []byte) error {
+	var info jsonBucketInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+	*b = BucketInfo(info)
+	return nil
+}
+
+// jsonBucketInfo exists to avoid recursion (and the BucketInfo.UnmarshalText method) when encoding JSON.
+type jsonBucketInfo struct {
+	Bucket string
+	Tags   map[string][]string
+}
+
+func (b BucketInfo) sortedTagKeys() []string {
+	keys := make(sortStringsBytesCompare, 0, len(b.Tags))
+	for key := range b.Tags {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	return keys
+}
+
+// clone returns a deep copy.
+func (b BucketInfo) clone() BucketInfo {
+	r := BucketInfo{
+		Bucket: b.Bucket,
+	}
+	if b.Tags != nil {
+		r.Tags = make(map[string][]string, len(b.Tags))
+		for key, values := range b.Tags {
+			r.Tags[key] = append([]string(nil), values...)
+		}
+	}
+	return r
+}
+
+// canonicalBucketKey is a BucketKeyFunc that returns the canonical text encoding, used by the Service
+// implementations that aggregate by BucketInfo, and therefore require a key that is unique per BucketInfo.
+func canonicalBucketKey(info BucketInfo) (string, bool) {
+	b, err := info.MarshalText()
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestBucketInfo_identity(t *testing.T) {
+	testCases := []struct {
+		A, B  BucketInfo
+		Equal bool
+		Text  string
+		JSON  string
+	}{
+		{
+			Equal: true,
+			Text:  ``,
+			JSON:  `{"Bucket":"","Tags":{}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{}},
+			B:     BucketInfo{Bucket: "bucket"},
+			Equal: true,
+			Text:  `bucket`,
+			JSON:  `{"Bucket":"bucket","Tags":{}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": nil}},
+			B:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {}}},
+			Equal: true,
+			Text:  `bucket,a`,
+			JSON:  `{"Bucket":"bucket","Tags":{"a":[]}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"b": {"2"}, "a": {"1", "x,y=z"}}},
+			B:     *(&BucketInfo{Bucket: "bucket"}).Tag("b", 2).Tag("a", 1, "x,y=z"),
+			Equal: true,
+			Text:  `bucket,a=1,a=x\,y=z,b=2`,
+			JSON:  `{"Bucket":"bucket","Tags":{"a":["1","x,y=z"],"b":["2"]}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: `a,b\c`, Tags: map[string][]string{"": {""}, "k=": {`\`}}},
+			B:     BucketInfo{Bucket: `a,b\c`, Tags: map[string][]string{"": {""}, "k=": {`\`}}},
+			Equal: true,
+			Text:  `a\,b\\c,=,k\==\\`,
+			JSON:  `{"Bucket":"a,b\\c","Tags":{"":[""],"k=":["\\"]}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {"1", "2"}}},
+			B:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {"2", "1"}}},
+			Equal: false,
+			Text:  `bucket,a=1,a=2`,
+			JSON:  `{"Bucket":"bucket","Tags":{"a":["1","2"]}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {"1"}}},
+			B:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"b": {"1"}}},
+			Equal: false,
+			Text:  `bucket,a=1`,
+			JSON:  `{"Bucket":"bucket","Tags":{"a":["1"]}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {"1"}}},
+			B:     BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {"1"}, "b": nil}},
+			Equal: false,
+			Text:  `bucket,a=1`,
+			JSON:  `{"Bucket":"bucket","Tags":{"a":["1"]}}`,
+		},
+		{
+			A:     BucketInfo{Bucket: "one"},
+			B:     BucketInfo{Bucket: "two"},
+			Equal: false,
+			Text:  `one`,
+			JSON:  `{"Bucket":"one","Tags":{}}`,
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestBucketInfo_identity_#%d", i+1)
+
+		if equal := testCase.A.Equal(testCase.B); equal != testCase.Equal {
+			t.Error(name, "equal", "expected =", testCase.Equal, "actual =", equal)
+		}
+		if equal := testCase.B.Equal(testCase.A); equal != testCase.Equal {
+			t.Error(name, "equal reversed", "expected =", testCase.Equal, "actual =", equal)
+		}
+		if equal := testCase.A.Hash() == testCase.B.Hash(); equal != testCase.Equal {
+			t.Error(name, "hash", "expected =", testCase.Equal, "actual =", equal)
+		}
+
+		if text, err := testCase.A.MarshalText(); err != nil || string(text) != testCase.Text {
+			t.Error(name, "text", "expected =", testCase.Text, "actual =", string(text), err)
+		} else {
+			var info BucketInfo
+			if err := info.UnmarshalText(text); err != nil || !info.Equal(testCase.A) {
+				t.Error(name, "text round trip", info, err)
+			}
+		}
+
+		if b, err := json.Marshal(testCase.A); err != nil || string(b) != testCase.JSON {
+			t.Error(name, "json", "expected =", testCase.JSON, "actual =", string(b), err)
+		} else {
+			var info BucketInfo
+			if err := json.Unmarshal(b, &info); err != nil || !info.Equal(testCase.A) {
+				t.Error(name, "json round trip", info, err)
+			}
+		}
+	}
+}
+
+func TestBucketInfo_Hash_stable(t *testing.T) {
+	const expected = 0xc5dc82bc71c61e6f
+	for i := 0; i < 10; i++ {
+		info := BucketInfo{
+			Bucket: "bucket",
+			Tags: map[string][]string{
+				"a": {"1", "2"},
+				"b": {"3"},
+				"c": nil,
+				"d": {"4"},
+			},
+		}
+		if hash := info.Hash(); hash != expected {
+			t.Fatalf("%#x", hash)
+		}
+	}
+}
+
+func TestBucketInfo_Hash_ambiguous(t *testing.T) {
+	a := BucketInfo{Bucket: "bucket", Tags: map[string][]string{"a": {"bc"}}}
+	b := BucketInfo{Bucket: "bucket", Tags: map[string][]string{"ab": {"c"}}}
+	c := BucketInfo{Bucket: "bucketa", Tags: map[string][]string{"bc": nil}}
+	if a.Hash() == b.Hash() || a.Hash() == c.Hash() || b.Hash() == c.Hash() {
+		t.Error(a.Hash(), b.Hash(), c.Hash())
+	}
+}
+
+func TestBucketInfo_UnmarshalJSON_error(t *testing.T) {
+	var info BucketInfo
+	if err := json.Unmarshal([]byte(`{"Bucket":1}`), &info); err == nil {
+		t.Error(info)
+	}
+}
@@ -0,0 +1,372 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// CarbonConfig configures a Service created by NewCarbonService, note that only Address is required.
+	CarbonConfig struct {
+		// Address is the address of the carbon receiver, e.g. "localhost:2003", or "localhost:2004" for pickle.
+		Address string
+		// Network defaults to "tcp".
+		Network string
+		// Dial may be used to override net.Dial.
+		Dial func(network, address string) (net.Conn, error)
+		// KeyFunc defaults to NewGraphitePathBucketKeyFunc(nil), NewGraphiteTaggedBucketKeyFunc is also supported.
+		KeyFunc BucketKeyFunc
+		// Interval is the aggregation interval for counts (and uniques), and how frequently datapoints will be
+		// flushed, it defaults to 10 seconds, and a negative value disables flushing in the background.
+		Interval time.Duration
+		// MaxPending is the max number of datapoints that will be buffered, after which the oldest will be dropped,
+		// it defaults to 10000.
+		MaxPending int
+		// WriteTimeout is the deadline for each write, it defaults to 10 seconds.
+		WriteTimeout time.Duration
+		// Pickle enables the pickle protocol, instead of the plaintext protocol.
+		Pickle bool
+		// PickleBatchSize is the max number of datapoints per pickle message, it defaults to 500.
+		PickleBatchSize int
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines counts datapoints, and StatQueueDepth is the number of pending datapoints.
+		Stats Bucket
+		// ErrorHandler will be called with any errors flushing in the background, if it is set.
+		ErrorHandler func(err error)
+	}
+
+	carbonService struct {
+		config     CarbonConfig
+		stats      *selfStats
+		conn       *reconnectingConn
+		counts     aggregator
+		mutex      sync.Mutex
+		pending    []carbonDatapoint
+		flushMutex sync.Mutex
+		// countsAt is the timestamp of the current interval's counts, and countTotals is the total of each count
+		// successfully written for countsAt, which subsequent flushes in the same interval add to, as carbon stores
+		// only the last value per path and timestamp, while countsPending is the paths with a pending count for
+		// countsAt, all of which are guarded by flushMutex.
+		countsAt      int64
+		countTotals   map[string]float64
+		countsPending map[string]struct{}
+		closeOnce     sync.Once
+		stop          chan struct{}
+		done          chan struct{}
+	}
+
+	carbonDatapoint struct {
+		path      string
+		value     float64
+		timestamp int64
+		// count indicates that the value is the running total of the path's counts, for the interval.
+		count bool
+	}
+)
+
+// NewCarbonService returns a Service that writes to Graphite, using the carbon plaintext protocol
+// ("path value timestamp"), or the pickle protocol, over TCP, reconnecting and retrying as necessary. Gauges,
+// histograms, and timings (in milliseconds) each become a datapoint, while counts are summed per interval, and
+// uniques are counted per interval, as carbon has no counter (or set) semantics. Counts (and uniques) are timestamped
+// with the flush time, truncated to the Interval, and as carbon stores a single value per path and timestamp, any
+// flushes within the same interval (e.g. Close) write the running total, merging counts and uniques that share a
+// path. Note that datapoints that fail to send will be retried by the next flush, which is safe, for the same reason.
+// https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+func NewCarbonService(config CarbonConfig) Service {
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.KeyFunc == nil {
+		config.KeyFunc = NewGraphitePathBucketKeyFunc(nil)
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second * 10
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 10000
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = time.Second * 10
+	}
+	if config.PickleBatchSize <= 0 {
+		config.PickleBatchSize = 500
+	}
+
+	s := &carbonService{
+		config: config,
+		stats:  newSelfStats(config.Stats),
+		conn: &reconnectingConn{
+			network:      config.Network,
+			address:      config.Address,
+			dial:         config.Dial,
+			writeTimeout: config.WriteTimeout,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if config.Interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+// Bucket returns a new bucket, using the configured KeyFunc.
+func (s *carbonService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, s.config.KeyFunc, s.sample)
+}
+
+// BucketAt returns a new bucket, like Bucket, except that gauges, histograms, and timings will be timestamped with
+// the given time, rather than the current time, see TimestampService.
+func (s *carbonService) BucketAt(bucket interface{}, timestamp time.Time) Bucket {
+	return NewBucket(bucket, s.config.KeyFunc, func(sample Sample) {
+		s.sampleAt(sample, timestamp)
+	})
+}
+
+// Flush writes all pending datapoints, including the current interval's counts.
+func (s *carbonService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.queue(s.queued)
+	defer s.stats.flushed(timeNow())
+
+	if timestamp := s.countTimestamp(); timestamp != s.countsAt || s.countTotals == nil {
+		s.countsAt = timestamp
+		s.countTotals = make(map[string]float64)
+		s.countsPending = make(map[string]struct{})
+	}
+
+	for _, series := range s.counts.flush() {
+		s.addCount(series.Key, series.Value())
+	}
+
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	b := s.encode(pending)
+
+	if err := s.conn.write(b); err != nil {
+		s.stats.error()
+		s.retry(pending)
+		return fmt.Errorf("appstats.carbonService.Flush write error: %s", err.Error())
+	}
+
+	for _, datapoint := range pending {
+		if datapoint.count && datapoint.timestamp == s.countsAt {
+			s.countTotals[datapoint.path] = datapoint.value
+			delete(s.countsPending, datapoint.path)
+		}
+	}
+
+	s.stats.sent(len(pending), len(b))
+
+	return nil
+}
+
+// discard drops all pending datapoints, rather than retrying them, see NewSpoolService.
+func (s *carbonService) discard() {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = nil
+	s.countsPending = make(map[string]struct{})
+}
+
+// countTimestamp returns the timestamp for the current interval's counts, which is the current time truncated to
+// the Interval, or to the second, if it is negative.
+func (s *carbonService) countTimestamp() int64 {
+	now := timeNow()
+	if s.config.Interval > 0 {
+		now = now.Truncate(s.config.Interval)
+	}
+	return now.Unix()
+}
+
+// addCount adds value to the running total of path, for countsAt, merging it with any pending count, note that it
+// must be called while holding flushMutex.
+func (s *carbonService) addCount(path string, value float64) {
+	if _, ok := s.countsPending[path]; ok {
+		s.mutex.Lock()
+		for i := len(s.pending) - 1; i >= 0; i-- {
+			if datapoint := &s.pending[i]; datapoint.count && datapoint.timestamp == s.countsAt && datapoint.path == path {
+				datapoint.value += value
+				s.mutex.Unlock()
+				return
+			}
+		}
+		s.mutex.Unlock()
+	}
+	s.countsPending[path] = struct{}{}
+	s.add(carbonDatapoint{
+		path:      path,
+		value:     s.countTotals[path] + value,
+		timestamp: s.countsAt,
+		count:     true,
+	})
+}
+
+// Close stops flushing in the background, then flushes, and closes the connection.
+func (s *carbonService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	err := s.Flush()
+	if closeErr := s.conn.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("appstats.carbonService.Close close error: %s", closeErr.Error())
+	}
+	return err
+}
+
+func (s *carbonService) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil && s.config.ErrorHandler != nil {
+				s.config.ErrorHandler(err)
+			}
+		}
+	}
+}
+
+func (s *carbonService) sample(sample Sample) {
+	s.sampleAt(sample, timeNow())
+}
+
+func (s *carbonService) sampleAt(sample Sample, timestamp time.Time) {
+	switch sample.Type {
+	case MetricCount, MetricUnique:
+		s.counts.add(sample)
+	default:
+		if value, ok := sample.Float64(); ok {
+			s.add(carbonDatapoint{
+				path:      sample.Key,
+				value:     value,
+				timestamp: timestamp.Unix(),
+			})
+		}
+	}
+}
+
+func (s *carbonService) add(datapoint carbonDatapoint) {
+	s.mutex.Lock()
+	var dropped int
+	if len(s.pending) >= s.config.MaxPending {
+		s.pending = s.pending[1:]
+		dropped++
+	}
+	s.pending = append(s.pending, datapoint)
+	s.mutex.Unlock()
+
+	s.stats.dropped(dropped)
+}
+
+// retry re-queues datapoints that failed to send, before any that were added in the meantime, dropping the oldest
+// to respect MaxPending.
+func (s *carbonService) retry(datapoints []carbonDatapoint) {
+	s.mutex.Lock()
+	var dropped int
+	datapoints = append(datapoints, s.pending...)
+	if len(datapoints) > s.config.MaxPending {
+		dropped = len(datapoints) - s.config.MaxPending
+		datapoints = datapoints[dropped:]
+	}
+	s.pending = datapoints
+	s.mutex.Unlock()
+
+	s.stats.dropped(dropped)
+}
+
+// queued returns the number of pending datapoints.
+func (s *carbonService) queued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.pending)
+}
+
+func (s *carbonService) encode(datapoints []carbonDatapoint) []byte {
+	var b bytes.Buffer
+	if s.config.Pickle {
+		for len(datapoints) > 0 {
+			n := s.config.PickleBatchSize
+			if n > len(datapoints) {
+				n = len(datapoints)
+			}
+			encodeCarbonPickle(&b, datapoints[:n])
+			datapoints = datapoints[n:]
+		}
+		return b.Bytes()
+	}
+	for _, datapoint := range datapoints {
+		b.WriteString(datapoint.path)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(datapoint.value, 'f', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(datapoint.timestamp, 10))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// encodeCarbonPickle writes a single pickle message, a 4-byte big-endian length header, followed by the equivalent
+// of pickle.dumps([(path, (timestamp, value)), ...], protocol=2).
+func encodeCarbonPickle(b *bytes.Buffer, datapoints []carbonDatapoint) {
+	var payload bytes.Buffer
+	payload.Write([]byte{0x80, 2}) // PROTO 2
+	payload.WriteByte(']')         // EMPTY_LIST
+	payload.WriteByte('(')         // MARK
+	for _, datapoint := range datapoints {
+		payload.WriteByte('X') // BINUNICODE
+		binary.Write(&payload, binary.LittleEndian, uint32(len(datapoint.path)))
+		payload.WriteString(datapoint.path)
+		payload.WriteByte('G') // BINFLOAT
+		binary.Write(&payload, binary.BigEndian, math.Float64bits(float64(datapoint.timestamp)))
+		payload.WriteByte('G') // BINFLOAT
+		binary.Write(&payload, binary.BigEndian, math.Float64bits(datapoint.value))
+		payload.WriteByte(0x86) // TUPLE2
+		payload.WriteByte(0x86) // TUPLE2
+	}
+	payload.WriteByte('e') // APPENDS
+	payload.WriteByte('.') // STOP
+	binary.Write(b, binary.BigEndian, uint32(payload.Len()))
+	b.Write(payload.Bytes())
+}
@@ -0,0 +1,437 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/go-test/deep"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testListener accepts TCP connections, and sends every line received to lines.
+type testListener struct {
+	net.Listener
+	lines chan string
+}
+
+func newTestListener(t *testing.T) *testListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testListener{
+		Listener: listener,
+		lines:    make(chan string, 1024),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					l.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func (l *testListener) expect(t *testing.T, lines ...string) {
+	t.Helper()
+	var actual []string
+	timeout := time.After(time.Second * 5)
+	for len(actual) < len(lines) {
+		select {
+		case line := <-l.lines:
+			actual = append(actual, line)
+		case <-timeout:
+			t.Fatal("timed out", actual)
+		}
+	}
+	if diff := deep.Equal(actual, lines); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func stubTimeNow(now time.Time) func() {
+	_timeNow := timeNow
+	timeNow = func() time.Time {
+		return now
+	}
+	return func() {
+		timeNow = _timeNow
+	}
+}
+
+func TestCarbonService_plaintext(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 0))()
+
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	s := NewCarbonService(CarbonConfig{
+		Address:  listener.Addr().String(),
+		Interval: -1,
+	})
+
+	bucket := s.Bucket("some.path").Tag("env", "prod")
+	bucket.Count(2)
+	bucket.Increment()
+	bucket.Gauge(1.5)
+	bucket.Histogram("12")
+	bucket.Timing(time.Millisecond * 250)
+	bucket.Unique("a")
+	bucket.Unique("b")
+	bucket.Unique("a")
+	bucket.Gauge("invalid")
+	s.Bucket("other").Increment()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.expect(
+		t,
+		"some.path.env.prod 1.5 1500000000",
+		"some.path.env.prod 12 1500000000",
+		"some.path.env.prod 250 1500000000",
+		"other 1 1500000000",
+		// counts and uniques sharing a path are merged
+		"some.path.env.prod 5 1500000000",
+	)
+
+	// within the same interval, the running total is written, as carbon keeps only the last value
+	bucket.Increment()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.expect(t, "some.path.env.prod 6 1500000000")
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCarbonService_bucketAt(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 0))()
+
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	s := NewCarbonService(CarbonConfig{
+		Address:  listener.Addr().String(),
+		Interval: -1,
+	})
+
+	bucket := s.(TimestampService).BucketAt("some.path", time.Unix(1400000000, 0)).Tag("env", "prod")
+	bucket.Gauge(1)
+	bucket.Increment()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.expect(
+		t,
+		"some.path.env.prod 1 1400000000",
+		"some.path.env.prod 1 1500000000",
+	)
+}
+
+func TestCarbonService_retry(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 0))()
+
+	var (
+		dials   int
+		written bytes.Buffer
+		mutex   sync.Mutex
+	)
+
+	stats, samples := newTestStatsBucket()
+
+	s := NewCarbonService(CarbonConfig{
+		Stats:      stats,
+		Interval:   -1,
+		MaxPending: 2,
+		KeyFunc:    NewGraphiteTaggedBucketKeyFunc(),
+		Dial: func(network, address string) (net.Conn, error) {
+			if network != "tcp" || address != "carbon:2003" {
+				t.Error(network, address)
+			}
+			dials++
+			if dials == 1 {
+				return nil, errors.New("some_error")
+			}
+			client, server := net.Pipe()
+			go func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				io.Copy(&written, server)
+			}()
+			return client, nil
+		},
+		Address: "carbon:2003",
+	})
+
+	s.Bucket("a").Gauge(1)
+
+	if err := s.Flush(); err == nil || err.Error() != "appstats.carbonService.Flush write error: some_error" {
+		t.Fatal(err)
+	}
+
+	s.Bucket("b").Tag("c", "d").Gauge(2)
+	s.Bucket("c").Gauge(3)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if dials != 2 {
+		t.Error(dials)
+	}
+
+	// the oldest was dropped
+	if s := written.String(); s != "b;c=d 2 1500000000\nc 3 1500000000\n" {
+		t.Error(s)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=errors count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 1",
+			"stats,stat=drops count 1",
+			"stats,stat=lines count 2",
+			"stats,stat=bytes count 34",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestCarbonService_counts(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000030, 0))()
+
+	var (
+		dials   int
+		written bytes.Buffer
+		mutex   sync.Mutex
+	)
+
+	s := NewCarbonService(CarbonConfig{
+		Interval: time.Minute,
+		Dial: func(network, address string) (net.Conn, error) {
+			dials++
+			if dials == 1 {
+				return nil, errors.New("some_error")
+			}
+			client, server := net.Pipe()
+			go func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				io.Copy(&written, server)
+			}()
+			return client, nil
+		},
+	})
+
+	s.Bucket("a").Increment()
+
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// merged with the pending count
+	stubTimeNow(time.Unix(1500000045, 0))
+	s.Bucket("a").Count(2)
+	s.Bucket("a").Unique("x")
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the running total, for the same interval
+	stubTimeNow(time.Unix(1500000059, 0))
+	s.Bucket("a").Increment()
+	s.Bucket("b").Increment()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next interval
+	stubTimeNow(time.Unix(1500000061, 0))
+	s.Bucket("a").Increment()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if diff := deep.Equal(
+		strings.Split(written.String(), "\n"),
+		[]string{
+			"a 4 1500000000",
+			"a 5 1500000000",
+			"b 1 1500000000",
+			"a 1 1500000060",
+			"",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestCarbonService_background(t *testing.T) {
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	errs := make(chan error, 1)
+
+	s := NewCarbonService(CarbonConfig{
+		Address:  listener.Addr().String(),
+		Interval: time.Millisecond * 10,
+		ErrorHandler: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	defer s.Close()
+
+	s.Bucket("a").Increment()
+
+	select {
+	case line := <-listener.lines:
+		if !strings.HasPrefix(line, "a 1 ") {
+			t.Error(line)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+
+	listener.Close()
+	s.(*carbonService).conn.close()
+	s.Bucket("a").Increment()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+}
+
+func TestEncodeCarbonPickle(t *testing.T) {
+	var b bytes.Buffer
+
+	encodeCarbonPickle(&b, []carbonDatapoint{{path: "a.b", value: 1.5, timestamp: 1500000000}})
+
+	var expected bytes.Buffer
+	expected.Write([]byte{0x80, 2, ']', '(', 'X', 3, 0, 0, 0, 'a', '.', 'b', 'G'})
+	binary.Write(&expected, binary.BigEndian, math.Float64bits(1500000000))
+	expected.WriteByte('G')
+	binary.Write(&expected, binary.BigEndian, math.Float64bits(1.5))
+	expected.Write([]byte{0x86, 0x86, 'e', '.'})
+
+	if length := binary.BigEndian.Uint32(b.Bytes()); int(length) != expected.Len() || length != uint32(b.Len()-4) {
+		t.Fatal(length, expected.Len(), b.Len())
+	}
+
+	if !bytes.Equal(b.Bytes()[4:], expected.Bytes()) {
+		t.Errorf("%q", b.Bytes()[4:])
+	}
+}
+
+func TestCarbonService_pickle(t *testing.T) {
+	var (
+		written bytes.Buffer
+		done    = make(chan struct{})
+	)
+
+	s := NewCarbonService(CarbonConfig{
+		Interval:        -1,
+		Pickle:          true,
+		PickleBatchSize: 2,
+		Dial: func(network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer close(done)
+				io.Copy(&written, server)
+			}()
+			return client, nil
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		s.Bucket("a").Gauge(i)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+
+	var messages int
+	for b := written.Bytes(); len(b) > 0; messages++ {
+		length := binary.BigEndian.Uint32(b)
+		if b[4] != 0x80 || b[4+length-1] != '.' {
+			t.Fatalf("%q", b)
+		}
+		b = b[4+length:]
+	}
+
+	if messages != 3 {
+		t.Error(messages)
+	}
+}
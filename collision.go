@@ -0,0 +1,116 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// DefaultKeyCollisionSize is the number of keys remembered by DetectKeyCollisions, if size is not positive.
+const DefaultKeyCollisionSize = 4096
+
+type (
+	// KeyCollision describes two different BucketInfo values (per BucketInfo.Equal) that generated the same key.
+	KeyCollision struct {
+		Key      string
+		Previous BucketInfo
+		Current  BucketInfo
+	}
+
+	keyCollisionDetector struct {
+		keyFunc     BucketKeyFunc
+		size        int
+		onCollision func(collision KeyCollision)
+		mutex       sync.Mutex
+		order       *list.List
+		origins     map[string]*list.Element
+	}
+
+	keyCollisionOrigin struct {
+		key  string
+		info BucketInfo
+	}
+)
+
+// DetectKeyCollisions wraps keyFunc, remembering the origin of up to size of the most recently used keys, calling
+// onCollision whenever a remembered key is generated from a different origin, e.g. tags {"Env":"prod"} and
+// {"env":"prod"}, which would otherwise be silently merged. The first origin of each key is retained, so every
+// subsequent use of the key from any other origin will be reported, and onCollision will be called synchronously,
+// so it should not block. Note that it will panic if keyFunc or onCollision are nil, and that it is safe for
+// concurrent use.
+func DetectKeyCollisions(keyFunc BucketKeyFunc, size int, onCollision func(collision KeyCollision)) BucketKeyFunc {
+	if keyFunc == nil {
+		panic(errors.New("appstats.DetectKeyCollisions nil key func"))
+	}
+	if onCollision == nil {
+		panic(errors.New("appstats.DetectKeyCollisions nil collision func"))
+	}
+	if size <= 0 {
+		size = DefaultKeyCollisionSize
+	}
+	d := &keyCollisionDetector{
+		keyFunc:     keyFunc,
+		size:        size,
+		onCollision: onCollision,
+		order:       list.New(),
+		origins:     make(map[string]*list.Element),
+	}
+	return d.bucketKey
+}
+
+func (d *keyCollisionDetector) bucketKey(info BucketInfo) (string, bool) {
+	key, ok := d.keyFunc(info)
+	if !ok {
+		return key, ok
+	}
+	if previous, ok := d.check(key, info); !ok {
+		d.onCollision(KeyCollision{
+			Key:      key,
+			Previous: previous,
+			Current:  info,
+		})
+	}
+	return key, ok
+}
+
+// check records the origin of key, returning the previous origin and false if it is different to info.
+func (d *keyCollisionDetector) check(key string, info BucketInfo) (BucketInfo, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if element, ok := d.origins[key]; ok {
+		d.order.MoveToFront(element)
+		origin := element.Value.(*keyCollisionOrigin)
+		return origin.info, origin.info.Equal(info)
+	}
+
+	if d.order.Len() >= d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.origins, oldest.Value.(*keyCollisionOrigin).key)
+	}
+
+	d.origins[key] = d.order.PushFront(&keyCollisionOrigin{
+		key:  key,
+		info: info.clone(),
+	})
+
+	return BucketInfo{}, true
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"github.com/go-test/deep"
+	"sync"
+	"testing"
+)
+
+func TestDetectKeyCollisions(t *testing.T) {
+	var collisions []KeyCollision
+
+	keyFunc := DetectKeyCollisions(DefaultBucketKeyFunc, 2, func(collision KeyCollision) {
+		collisions = append(collisions, collision)
+	})
+
+	upper := BucketInfo{Bucket: "bucket", Tags: map[string][]string{"Env": {"prod"}}}
+	lower := BucketInfo{Bucket: "bucket", Tags: map[string][]string{"env": {"prod"}}}
+
+	for _, info := range []BucketInfo{upper, upper, lower} {
+		if key, ok := keyFunc(info); key != "bucket,env=prod" || !ok {
+			t.Fatal(key, ok)
+		}
+	}
+
+	if key, ok := keyFunc(BucketInfo{Bucket: "123"}); key != "" || ok {
+		t.Fatal(key, ok)
+	}
+
+	if diff := deep.Equal(collisions, []KeyCollision{
+		{
+			Key:      "bucket,env=prod",
+			Previous: upper,
+			Current:  lower,
+		},
+	}); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// the origin is retained, and cannot be modified via the original info
+	upper.Tags["Env"][0] = "modified"
+	collisions = nil
+	keyFunc(lower)
+	if len(collisions) != 1 || collisions[0].Previous.Tags["Env"][0] != "prod" {
+		t.Fatal(collisions)
+	}
+}
+
+func TestDetectKeyCollisions_bounded(t *testing.T) {
+	var collisions int
+
+	keyFunc := DetectKeyCollisions(DefaultBucketKeyFunc, 2, func(collision KeyCollision) {
+		collisions++
+	})
+
+	keyFunc(BucketInfo{Bucket: "A"})
+	keyFunc(BucketInfo{Bucket: "b"})
+	keyFunc(BucketInfo{Bucket: "c"})
+	// evicted
+	keyFunc(BucketInfo{Bucket: "a"})
+	if collisions != 0 {
+		t.Fatal(collisions)
+	}
+	// still present
+	keyFunc(BucketInfo{Bucket: "C"})
+	if collisions != 1 {
+		t.Fatal(collisions)
+	}
+}
+
+func TestDetectKeyCollisions_concurrent(t *testing.T) {
+	var (
+		mutex      sync.Mutex
+		collisions int
+		wg         sync.WaitGroup
+	)
+	keyFunc := DetectKeyCollisions(DefaultBucketKeyFunc, 0, func(collision KeyCollision) {
+		mutex.Lock()
+		collisions++
+		mutex.Unlock()
+	})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				keyFunc(BucketInfo{Bucket: "bucket"})
+			}
+		}()
+	}
+	wg.Wait()
+	if collisions != 0 {
+		t.Error(collisions)
+	}
+}
+
+func TestDetectKeyCollisions_nil(t *testing.T) {
+	for _, fn := range []func(){
+		func() { DetectKeyCollisions(nil, 0, func(collision KeyCollision) {}) },
+		func() { DetectKeyCollisions(DefaultBucketKeyFunc, 0, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errReconnectBackoff is returned by reconnectingConn.write, if it did not attempt to dial, due to backoff.
+var errReconnectBackoff = errors.New("appstats.reconnectingConn reconnect backoff")
+
+type (
+	// reconnectingConn lazily dials a connection, which will be closed on any write error, and re-dialed by the
+	// next write, used by the Service implementations that write to a stream. If backoff is set, then after any
+	// error, the next dial will not be attempted until after a delay, which starts at backoff, and doubles for each
+	// consecutive error, up to maxBackoff (if set).
+	reconnectingConn struct {
+		network      string
+		address      string
+		dial         func(network, address string) (net.Conn, error)
+		writeTimeout time.Duration
+		backoff      time.Duration
+		maxBackoff   time.Duration
+		mutex        sync.Mutex
+		conn         net.Conn
+		delay        time.Duration
+		retryAt      time.Time
+	}
+)
+
+// write writes all of b, dialing a new connection if necessary, note that if an error occurs, an unknown amount of
+// b may have been written. While backing off, errReconnectBackoff will be returned, and nothing will be written.
+func (c *reconnectingConn) write(b []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if c.delay != 0 && timeNow().Before(c.retryAt) {
+			return errReconnectBackoff
+		}
+		dial := c.dial
+		if dial == nil {
+			dial = net.Dial
+		}
+		conn, err := dial(c.network, c.address)
+		if err != nil {
+			c.failedLocked()
+			return err
+		}
+		c.conn = conn
+	}
+
+	if c.writeTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			c.closeLocked()
+			c.failedLocked()
+			return err
+		}
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		c.closeLocked()
+		c.failedLocked()
+		return err
+	}
+
+	c.delay = 0
+
+	return nil
+}
+
+// failedLocked increases the reconnect delay, if backoff is enabled.
+func (c *reconnectingConn) failedLocked() {
+	if c.backoff <= 0 {
+		return
+	}
+	if c.delay == 0 {
+		c.delay = c.backoff
+	} else {
+		c.delay *= 2
+	}
+	if c.maxBackoff > 0 && c.delay > c.maxBackoff {
+		c.delay = c.maxBackoff
+	}
+	c.retryAt = timeNow().Add(c.delay)
+}
+
+// ready returns false if the next write would return errReconnectBackoff.
+func (c *reconnectingConn) ready() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil || c.delay == 0 || !timeNow().Before(c.retryAt)
+}
+
+func (c *reconnectingConn) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closeLocked()
+}
+
+func (c *reconnectingConn) closeLocked() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
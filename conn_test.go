@@ -0,0 +1,141 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type mockConn struct {
+	net.Conn
+	write  func(b []byte) (int, error)
+	closed int
+}
+
+func (c *mockConn) Write(b []byte) (int, error) {
+	return c.write(b)
+}
+
+func (c *mockConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *mockConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReconnectingConn_write(t *testing.T) {
+	var conns []*mockConn
+
+	c := &reconnectingConn{
+		network:      "tcp",
+		address:      "address",
+		writeTimeout: time.Second,
+		dial: func(network, address string) (net.Conn, error) {
+			if network != "tcp" || address != "address" {
+				t.Error(network, address)
+			}
+			conn := &mockConn{
+				write: func(b []byte) (int, error) {
+					if len(conns) == 1 {
+						return 0, errors.New("some_error")
+					}
+					return len(b), nil
+				},
+			}
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	}
+
+	if err := c.write([]byte("a")); err == nil || err.Error() != "some_error" {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].closed != 1 || c.conn != nil {
+		t.Fatal(conns, c.conn)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.write([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(conns) != 2 || conns[1].closed != 0 {
+		t.Fatal(conns)
+	}
+
+	if err := c.close(); err != nil || conns[1].closed != 1 || c.conn != nil {
+		t.Fatal(err, conns)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectingConn_dialError(t *testing.T) {
+	c := &reconnectingConn{
+		dial: func(network, address string) (net.Conn, error) {
+			return nil, errors.New("some_error")
+		},
+	}
+	if err := c.write(nil); err == nil || err.Error() != "some_error" {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectingConn_backoff(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	var dials int
+	c := &reconnectingConn{
+		backoff:    time.Second,
+		maxBackoff: time.Second * 3,
+		dial: func(network, address string) (net.Conn, error) {
+			dials++
+			if dials <= 3 {
+				return nil, errors.New("some_error")
+			}
+			return &mockConn{write: func(b []byte) (int, error) { return len(b), nil }}, nil
+		},
+	}
+
+	for i, step := range []struct {
+		Now   int64
+		Err   error
+		Dials int
+		Delay time.Duration
+	}{
+		{Now: 100, Err: errors.New("some_error"), Dials: 1, Delay: time.Second},
+		{Now: 100, Err: errReconnectBackoff, Dials: 1, Delay: time.Second},
+		{Now: 101, Err: errors.New("some_error"), Dials: 2, Delay: time.Second * 2},
+		{Now: 102, Err: errReconnectBackoff, Dials: 2, Delay: time.Second * 2},
+		{Now: 103, Err: errors.New("some_error"), Dials: 3, Delay: time.Second * 3},
+		{Now: 106, Dials: 4},
+	} {
+		stubTimeNow(time.Unix(step.Now, 0))
+		err := c.write([]byte("a"))
+		if (err == nil) != (step.Err == nil) || (err != nil && err.Error() != step.Err.Error()) ||
+			dials != step.Dials || c.delay != step.Delay {
+			t.Error(i, err, dials, c.delay)
+		}
+	}
+}
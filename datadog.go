@@ -0,0 +1,392 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DatadogTypeCount is the Datadog metric intake type for counts.
+	DatadogTypeCount = 1
+	// DatadogTypeRate is the Datadog metric intake type for rates (per second).
+	DatadogTypeRate = 2
+	// DatadogTypeGauge is the Datadog metric intake type for gauges.
+	DatadogTypeGauge = 3
+)
+
+type (
+	// DatadogConfig configures a Service created by NewDatadogService, note that only APIKey is required.
+	DatadogConfig struct {
+		// APIKey is sent as the DD-API-KEY header.
+		APIKey string
+		// URL is the base URL of the API, it defaults to "https://api.datadoghq.com", and may be overridden to use
+		// another site, e.g. "https://api.datadoghq.eu", or a local stand-in.
+		URL string
+		// Client defaults to http.DefaultClient.
+		Client *http.Client
+		// DisableCompression disables gzip compression of request bodies.
+		DisableCompression bool
+		// Sanitisers defaults to DatadogKeySanitisers(), per field.
+		Sanitisers KeySanitisers
+		// Host will be set as the host of every series, if it is set.
+		Host string
+		// Tags, in the format "key:value", will be added to every series.
+		Tags []string
+		// CountsAsRate submits counts as rates (per second) rather than counts.
+		CountsAsRate bool
+		// Interval is the aggregation interval, and how frequently metrics will be submitted, it defaults to 10
+		// seconds, and a negative value disables submitting in the background.
+		Interval time.Duration
+		// MaxBatchSize is the max number of series per request, it defaults to 1000.
+		MaxBatchSize int
+		// MaxRetries is the max number of times a failed request will be retried, it defaults to 3, and a negative
+		// value disables retries.
+		MaxRetries int
+		// RetryBackoff is the delay before the first retry, which doubles for each retry, it defaults to 1 second.
+		RetryBackoff time.Duration
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines counts series, and StatDrops counts series that failed to submit.
+		Stats Bucket
+		// ErrorHandler will be called with any errors submitting in the background, if it is set.
+		ErrorHandler func(err error)
+	}
+
+	datadogService struct {
+		config     DatadogConfig
+		sender     httpSender
+		stats      *selfStats
+		aggregator aggregator
+		flushMutex sync.Mutex
+		// last is the time of the last flush, used to calculate the interval of counts and rates.
+		last      time.Time
+		closeOnce sync.Once
+		stop      chan struct{}
+		done      chan struct{}
+	}
+
+	datadogSeriesPayload struct {
+		Series []datadogSeries `json:"series"`
+	}
+
+	datadogSeries struct {
+		Metric    string            `json:"metric"`
+		Type      int               `json:"type"`
+		Interval  int64             `json:"interval,omitempty"`
+		Points    []datadogPoint    `json:"points"`
+		Tags      []string          `json:"tags,omitempty"`
+		Resources []datadogResource `json:"resources,omitempty"`
+	}
+
+	datadogPoint struct {
+		Timestamp int64   `json:"timestamp"`
+		Value     float64 `json:"value"`
+	}
+
+	datadogResource struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+
+	datadogDistributionPayload struct {
+		Series []datadogDistribution `json:"series"`
+	}
+
+	datadogDistribution struct {
+		Metric string `json:"metric"`
+		Type   string `json:"type"`
+		// Points are like [[timestamp, [value, ...]]].
+		Points [][]interface{} `json:"points"`
+		Tags   []string        `json:"tags,omitempty"`
+		Host   string          `json:"host,omitempty"`
+	}
+)
+
+// NewDatadogService returns a Service that aggregates metrics per interval, and submits them directly to the
+// Datadog API, for environments without a DogStatsD agent, retrying with backoff, and compressing requests with gzip.
+// Each bucket's tags are submitted as "key:value" tags, with a tag per value, and tags with no values as just "key".
+//
+// Counts are submitted to /api/v2/series as counts (or rates, if CountsAsRate), gauges as gauges (of the last
+// value), and uniques as gauges of the number of distinct values per interval, while histograms and timings (in
+// milliseconds) are submitted to /api/v1/distribution_points as distributions, with every value. Note that, as
+// the metrics are deltas, any that fail to submit, after retries, will be dropped.
+// https://docs.datadoghq.com/api/latest/metrics/
+func NewDatadogService(config DatadogConfig) Service {
+	if config.URL == "" {
+		config.URL = "https://api.datadoghq.com"
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	defaults := DatadogKeySanitisers()
+	if config.Sanitisers.Bucket == nil {
+		config.Sanitisers.Bucket = defaults.Bucket
+	}
+	if config.Sanitisers.TagKey == nil {
+		config.Sanitisers.TagKey = defaults.TagKey
+	}
+	if config.Sanitisers.TagValue == nil {
+		config.Sanitisers.TagValue = defaults.TagValue
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second * 10
+	}
+	if config.MaxBatchSize <= 0 {
+		config.MaxBatchSize = 1000
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	s := &datadogService{
+		config: config,
+		sender: httpSender{
+			client:     config.Client,
+			maxRetries: config.MaxRetries,
+			backoff:    config.RetryBackoff,
+		},
+		stats:      newSelfStats(config.Stats),
+		aggregator: aggregator{values: true},
+		last:       timeNow(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if config.Interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+// Bucket returns a new bucket, keyed by the sanitised metric and tags, so that buckets which only differ prior to
+// sanitisation, e.g. "Requests" and "requests", are aggregated as the same series, rather than being submitted as
+// separate series with the same metric, tags, and timestamp, of which Datadog would keep only one.
+func (s *datadogService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, s.key, s.sample)
+}
+
+// Flush submits all metrics aggregated since the last flush, in batches, returning the first error.
+func (s *datadogService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.flushed(timeNow())
+
+	now := timeNow()
+	timestamp := now.Unix()
+	interval := int64(now.Sub(s.last).Seconds() + 0.5)
+	if interval < 1 {
+		interval = 1
+	}
+	s.last = now
+
+	var (
+		series        []datadogSeries
+		distributions []datadogDistribution
+	)
+
+	for _, v := range s.aggregator.flush() {
+		metric := s.config.Sanitisers.Bucket(v.Info.Bucket)
+		if metric == "" {
+			continue
+		}
+		tags := s.tags(v.Info)
+
+		switch v.Type {
+		case MetricCount:
+			value, metricType := v.Sum, DatadogTypeCount
+			if s.config.CountsAsRate {
+				value, metricType = value/float64(interval), DatadogTypeRate
+			}
+			series = append(series, s.series(metric, metricType, interval, tags, timestamp, value))
+		case MetricGauge, MetricUnique:
+			series = append(series, s.series(metric, DatadogTypeGauge, 0, tags, timestamp, v.Value()))
+		default:
+			distributions = append(distributions, datadogDistribution{
+				Metric: metric,
+				Type:   "distribution",
+				Points: [][]interface{}{{timestamp, v.Values}},
+				Tags:   tags,
+				Host:   s.config.Host,
+			})
+		}
+	}
+
+	var err error
+	setErr := func(sendErr error) {
+		if sendErr != nil && err == nil {
+			err = fmt.Errorf("appstats.datadogService.Flush send error: %s", sendErr.Error())
+		}
+	}
+
+	for len(series) > 0 {
+		n := s.config.MaxBatchSize
+		if n > len(series) {
+			n = len(series)
+		}
+		setErr(s.send("/api/v2/series", datadogSeriesPayload{Series: series[:n]}, n))
+		series = series[n:]
+	}
+
+	for len(distributions) > 0 {
+		n := s.config.MaxBatchSize
+		if n > len(distributions) {
+			n = len(distributions)
+		}
+		setErr(s.send("/api/v1/distribution_points", datadogDistributionPayload{Series: distributions[:n]}, n))
+		distributions = distributions[n:]
+	}
+
+	return err
+}
+
+// Close stops submitting in the background, then flushes.
+func (s *datadogService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.Flush()
+}
+
+func (s *datadogService) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil && s.config.ErrorHandler != nil {
+				s.config.ErrorHandler(err)
+			}
+		}
+	}
+}
+
+func (s *datadogService) sample(sample Sample) {
+	s.aggregator.add(sample)
+}
+
+func (s *datadogService) series(metric string, metricType int, interval int64, tags []string, timestamp int64, value float64) datadogSeries {
+	series := datadogSeries{
+		Metric:   metric,
+		Type:     metricType,
+		Interval: interval,
+		Points:   []datadogPoint{{Timestamp: timestamp, Value: value}},
+		Tags:     tags,
+	}
+	if s.config.Host != "" {
+		series.Resources = []datadogResource{{Type: "host", Name: s.config.Host}}
+	}
+	return series
+}
+
+// key returns the sanitised metric, followed by the sanitised tags of info, sorted and deduplicated, as JSON.
+func (s *datadogService) key(info BucketInfo) (string, bool) {
+	metric := s.config.Sanitisers.Bucket(info.Bucket)
+	if metric == "" {
+		return "", false
+	}
+	tags := s.tags(info)
+	sort.Strings(tags)
+	key := []string{metric}
+	for i, tag := range tags {
+		if i == 0 || tag != tags[i-1] {
+			key = append(key, tag)
+		}
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// tags returns the configured tags, followed by the sanitised tags of info, sorted by key.
+func (s *datadogService) tags(info BucketInfo) []string {
+	tags := append([]string(nil), s.config.Tags...)
+	for _, key := range info.sortedTagKeys() {
+		values := info.Tags[key]
+		if key = s.config.Sanitisers.TagKey(key); key == "" {
+			continue
+		}
+		if len(values) == 0 {
+			tags = append(tags, key)
+			continue
+		}
+		for _, value := range values {
+			if value = s.config.Sanitisers.TagValue(value); value != "" {
+				tags = append(tags, key+":"+value)
+			}
+		}
+	}
+	return tags
+}
+
+// send submits a payload, containing the given number of series.
+func (s *datadogService) send(path string, payload interface{}, series int) error {
+	size, err := s.post(path, payload)
+	if err != nil {
+		s.stats.error()
+		s.stats.dropped(series)
+		return err
+	}
+	s.stats.sent(series, size)
+	return nil
+}
+
+// post encodes and submits a payload, returning the size of the body.
+func (s *datadogService) post(path string, payload interface{}) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	header := http.Header{
+		"Content-Type": {"application/json"},
+		"Dd-Api-Key":   {s.config.APIKey},
+	}
+
+	if !s.config.DisableCompression {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		_, _ = w.Write(body)
+		if err := w.Close(); err != nil {
+			return 0, err
+		}
+		body = b.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	return len(body), s.sender.send(http.MethodPost, s.config.URL+path, header, body)
+}
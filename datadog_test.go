@@ -0,0 +1,289 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+type datadogTestServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string][]interface{}
+	status   []int
+}
+
+func newDatadogTestServer(t *testing.T, compressed bool) *datadogTestServer {
+	s := &datadogTestServer{requests: make(map[string][]interface{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if len(s.status) != 0 {
+			status := s.status[0]
+			s.status = s.status[1:]
+			if status != http.StatusAccepted {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		if r.Method != http.MethodPost ||
+			r.Header.Get("DD-API-KEY") != "key" ||
+			r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected request", r.Method, r.Header)
+		}
+		var body io.Reader = r.Body
+		if compressed {
+			if r.Header.Get("Content-Encoding") != "gzip" {
+				t.Error("unexpected encoding", r.Header.Get("Content-Encoding"))
+			}
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		} else if r.Header.Get("Content-Encoding") != "" {
+			t.Error("unexpected encoding", r.Header.Get("Content-Encoding"))
+		}
+		var payload interface{}
+		if err := json.NewDecoder(body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		s.requests[r.URL.Path] = append(s.requests[r.URL.Path], payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return s
+}
+
+func TestDatadogService(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 0))()
+
+	server := newDatadogTestServer(t, true)
+	defer server.Close()
+
+	s := NewDatadogService(DatadogConfig{
+		APIKey:   "key",
+		URL:      server.URL + "/",
+		Client:   server.Client(),
+		Host:     "web01",
+		Tags:     []string{"env:prod"},
+		Interval: -1,
+	})
+
+	s.Bucket("Requests").Tag("status", "200").Tag("flag").Count(2)
+	s.Bucket("Requests").Tag("status", "200").Tag("flag").Increment()
+	s.Bucket("queue").Gauge(4)
+	s.Bucket("users").Unique("a")
+	s.Bucket("users").Unique("b")
+	s.Bucket("latency").Tag("region", "a", "b").Timing(time.Millisecond * 20)
+	s.Bucket("latency").Tag("region", "a", "b").Timing(time.Millisecond * 30)
+
+	defer stubTimeNow(time.Unix(1500000010, 0))()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	host := []interface{}{map[string]interface{}{"type": "host", "name": "web01"}}
+
+	if diff := deep.Equal(
+		server.requests,
+		map[string][]interface{}{
+			"/api/v2/series": {
+				map[string]interface{}{
+					"series": []interface{}{
+						map[string]interface{}{
+							"metric":    "queue",
+							"type":      float64(DatadogTypeGauge),
+							"points":    []interface{}{map[string]interface{}{"timestamp": float64(1500000010), "value": float64(4)}},
+							"tags":      []interface{}{"env:prod"},
+							"resources": host,
+						},
+						map[string]interface{}{
+							"metric":    "requests",
+							"type":      float64(DatadogTypeCount),
+							"interval":  float64(10),
+							"points":    []interface{}{map[string]interface{}{"timestamp": float64(1500000010), "value": float64(3)}},
+							"tags":      []interface{}{"env:prod", "flag", "status:200"},
+							"resources": host,
+						},
+						map[string]interface{}{
+							"metric":    "users",
+							"type":      float64(DatadogTypeGauge),
+							"points":    []interface{}{map[string]interface{}{"timestamp": float64(1500000010), "value": float64(2)}},
+							"tags":      []interface{}{"env:prod"},
+							"resources": host,
+						},
+					},
+				},
+			},
+			"/api/v1/distribution_points": {
+				map[string]interface{}{
+					"series": []interface{}{
+						map[string]interface{}{
+							"metric": "latency",
+							"type":   "distribution",
+							"points": []interface{}{[]interface{}{float64(1500000010), []interface{}{float64(20), float64(30)}}},
+							"tags":   []interface{}{"env:prod", "region:a", "region:b"},
+							"host":   "web01",
+						},
+					},
+				},
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDatadogService_sanitisedCollision(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	server := newDatadogTestServer(t, false)
+	defer server.Close()
+
+	s := NewDatadogService(DatadogConfig{
+		APIKey:             "key",
+		URL:                server.URL,
+		Client:             server.Client(),
+		DisableCompression: true,
+		Interval:           -1,
+	})
+
+	s.Bucket("Requests").Tag("Env", "x").Count(2)
+	s.Bucket("requests").Tag("env", "x").Count(3)
+	s.Bucket("requests").Tag("env", "y").Increment()
+
+	defer stubTimeNow(time.Unix(110, 0))()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		server.requests,
+		map[string][]interface{}{
+			"/api/v2/series": {
+				map[string]interface{}{
+					"series": []interface{}{
+						map[string]interface{}{
+							"metric":   "requests",
+							"type":     float64(DatadogTypeCount),
+							"interval": float64(10),
+							"points":   []interface{}{map[string]interface{}{"timestamp": float64(110), "value": float64(5)}},
+							"tags":     []interface{}{"env:x"},
+						},
+						map[string]interface{}{
+							"metric":   "requests",
+							"type":     float64(DatadogTypeCount),
+							"interval": float64(10),
+							"points":   []interface{}{map[string]interface{}{"timestamp": float64(110), "value": float64(1)}},
+							"tags":     []interface{}{"env:y"},
+						},
+					},
+				},
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDatadogService_rateAndRetry(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	server := newDatadogTestServer(t, false)
+	defer server.Close()
+
+	server.status = []int{http.StatusTooManyRequests, http.StatusAccepted}
+
+	s := NewDatadogService(DatadogConfig{
+		APIKey:             "key",
+		URL:                server.URL,
+		Client:             server.Client(),
+		DisableCompression: true,
+		CountsAsRate:       true,
+		Interval:           -1,
+		MaxRetries:         1,
+		RetryBackoff:       time.Millisecond,
+	})
+
+	s.Bucket("a").Count(20)
+
+	defer stubTimeNow(time.Unix(104, 0))()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		server.requests,
+		map[string][]interface{}{
+			"/api/v2/series": {
+				map[string]interface{}{
+					"series": []interface{}{
+						map[string]interface{}{
+							"metric":   "a",
+							"type":     float64(DatadogTypeRate),
+							"interval": float64(4),
+							"points":   []interface{}{map[string]interface{}{"timestamp": float64(104), "value": float64(5)}},
+						},
+					},
+				},
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDatadogService_error(t *testing.T) {
+	server := newDatadogTestServer(t, true)
+	defer server.Close()
+
+	server.status = []int{http.StatusForbidden}
+
+	stats, samples := newTestStatsBucket()
+
+	s := NewDatadogService(DatadogConfig{
+		APIKey:   "key",
+		URL:      server.URL,
+		Client:   server.Client(),
+		Stats:    stats,
+		Interval: -1,
+	})
+
+	s.Bucket("a").Increment()
+
+	if err := s.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+
+	r := samples()
+	if len(r) != 3 || r[0] != "stats,stat=errors count 1" || r[1] != "stats,stat=drops count 1" {
+		t.Error(r)
+	}
+}
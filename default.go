@@ -0,0 +1,162 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"sync/atomic"
+)
+
+type (
+	// defaultService is the Service returned by Default, which forwards to the current default.
+	defaultService struct{}
+
+	// defaultBucket is a Bucket returned by defaultService, which resolves the equivalent bucket of the current
+	// default lazily, caching it until the default changes.
+	defaultBucket struct {
+		bucket *bucketState
+		cache  *atomic.Value
+	}
+
+	// defaultHolder wraps the current default, as a Service may not be comparable, and atomic.Value requires a
+	// consistent type.
+	defaultHolder struct {
+		service Service
+	}
+
+	defaultResolved struct {
+		holder *defaultHolder
+		bucket Bucket
+	}
+)
+
+var defaultValue atomic.Value
+
+func init() {
+	SetDefault(nil)
+}
+
+// SetDefault atomically replaces the Service used by Default, e.g. to be set once, early in main, note that a nil
+// service resets it to the initial no-op Service, backed by a stub StatsDClient, and that the Service returned by
+// Default is ignored. The previous default is not closed (or flushed).
+func SetDefault(service Service) {
+	if service == nil {
+		service = NewStatsDService(nil, nil)
+	}
+	if _, ok := service.(defaultService); ok {
+		return
+	}
+	defaultValue.Store(&defaultHolder{service: service})
+}
+
+// Default returns a Service that forwards to the Service most recently passed to SetDefault, which allows libraries
+// to send metrics without a Service being provided to them, similar to log/slog. Every Bucket (including any derived
+// using Tag) forwards to the current default, even if it was obtained before SetDefault was called, meaning it is
+// safe to store in a package variable, note that the tags are re-applied once per bucket, after each change.
+func Default() Service {
+	return defaultService{}
+}
+
+func loadDefault() *defaultHolder {
+	return defaultValue.Load().(*defaultHolder)
+}
+
+// Close closes the current default.
+func (defaultService) Close() error {
+	return loadDefault().service.Close()
+}
+
+// Flush flushes the current default.
+func (defaultService) Flush() error {
+	return loadDefault().service.Flush()
+}
+
+// Enabled returns the result of Enabled for the current default, which is false for the initial no-op Service.
+func (defaultService) Enabled() bool {
+	return Enabled(loadDefault().service)
+}
+
+// Bucket returns a new bucket, which forwards to the current default.
+func (defaultService) Bucket(bucket interface{}) Bucket {
+	return defaultBucket{
+		bucket: newBucketState(bucket),
+		cache:  new(atomic.Value),
+	}
+}
+
+// Tag returns a bucket with the tag and possibly values appended, string formatting all args with `%v`, note that
+// this WILL NOT modify the original bucket.
+func (b defaultBucket) Tag(key interface{}, values ...interface{}) Bucket {
+	return defaultBucket{
+		bucket: b.bucket.tag(key, values...),
+		cache:  new(atomic.Value),
+	}
+}
+
+// Enabled returns the result of Enabled for the equivalent bucket of the current default.
+func (b defaultBucket) Enabled() bool {
+	return Enabled(b.resolve())
+}
+
+// Count forwards to the current default.
+func (b defaultBucket) Count(n interface{}) {
+	b.resolve().Count(n)
+}
+
+// Increment forwards to the current default.
+func (b defaultBucket) Increment() {
+	b.resolve().Increment()
+}
+
+// Gauge forwards to the current default.
+func (b defaultBucket) Gauge(value interface{}) {
+	b.resolve().Gauge(value)
+}
+
+// Histogram forwards to the current default.
+func (b defaultBucket) Histogram(value interface{}) {
+	b.resolve().Histogram(value)
+}
+
+// Unique forwards to the current default.
+func (b defaultBucket) Unique(value interface{}) {
+	b.resolve().Unique(value)
+}
+
+// Timing forwards to the current default.
+func (b defaultBucket) Timing(value interface{}) {
+	b.resolve().Timing(value)
+}
+
+// resolve returns the equivalent bucket of the current default, applying the tags in order of key.
+func (b defaultBucket) resolve() Bucket {
+	holder := loadDefault()
+
+	if resolved, ok := b.cache.Load().(defaultResolved); ok && resolved.holder == holder {
+		return resolved.bucket
+	}
+
+	info := b.bucket.Info()
+	bucket := applyBucketTags(holder.service.Bucket(info.Bucket), info)
+
+	b.cache.Store(defaultResolved{
+		holder: holder,
+		bucket: bucket,
+	})
+
+	return bucket
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// recordingService records every sample, like "name,tag=value count 1", and returns errors for Flush and Close.
+type recordingService struct {
+	mutex   sync.Mutex
+	samples []string
+	err     error
+}
+
+func (s *recordingService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, func(sample Sample) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.samples = append(s.samples, fmt.Sprintf("%s %s %v", sample.Key, sample.Type, sample.Value))
+	})
+}
+
+func (s *recordingService) Flush() error {
+	return s.err
+}
+
+func (s *recordingService) Close() error {
+	return s.err
+}
+
+func (s *recordingService) take() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := s.samples
+	s.samples = nil
+	return r
+}
+
+func TestDefault(t *testing.T) {
+	defer SetDefault(nil)
+
+	bucket := Default().Bucket("a").Tag("k", "v")
+	other := bucket.Tag("x")
+
+	// the initial default is a no-op
+	bucket.Increment()
+	if err := Default().Flush(); err != nil {
+		t.Error(err)
+	}
+
+	first := &recordingService{err: errors.New("some_error")}
+	SetDefault(first)
+
+	bucket.Count(2)
+	other.Gauge(1)
+	bucket.Histogram(3)
+
+	if err := Default().Flush(); err == nil || err.Error() != "some_error" {
+		t.Error(err)
+	}
+	if err := Default().Close(); err == nil || err.Error() != "some_error" {
+		t.Error(err)
+	}
+
+	// ignored, as it would recurse
+	SetDefault(Default())
+
+	second := &recordingService{}
+	SetDefault(second)
+
+	bucket.Unique("u")
+	other.Timing(1)
+	Default().Bucket("b").Increment()
+
+	SetDefault(nil)
+
+	bucket.Increment()
+
+	if diff := deep.Equal(
+		first.take(),
+		[]string{
+			"a,k=v count 2",
+			"a,k=v,x gauge 1",
+			"a,k=v histogram 3",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		second.take(),
+		[]string{
+			"a,k=v unique u",
+			"a,k=v,x timing 1",
+			"b count 1",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDefault_Enabled(t *testing.T) {
+	defer SetDefault(nil)
+
+	bucket := Default().Bucket("a")
+
+	if Enabled(Default()) || Enabled(bucket) {
+		t.Error("expected disabled")
+	}
+
+	SetDefault(&recordingService{})
+
+	if !Enabled(Default()) || !Enabled(bucket) {
+		t.Error("expected enabled")
+	}
+	if Enabled(Default().Bucket("")) {
+		t.Error("expected disabled")
+	}
+}
+
+func TestDefault_concurrent(t *testing.T) {
+	defer SetDefault(nil)
+
+	bucket := Default().Bucket("a")
+
+	var (
+		services []*recordingService
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				bucket.Increment()
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		service := &recordingService{}
+		services = append(services, service)
+		SetDefault(service)
+	}
+
+	wg.Wait()
+
+	// everything sent after the last swap must have gone to the last service
+	last := services[len(services)-1]
+	last.take()
+	bucket.Increment()
+	if diff := deep.Equal(last.take(), []string{"a count 1"}); diff != nil {
+		t.Error(diff)
+	}
+}
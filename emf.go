@@ -0,0 +1,353 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EMFMaxMetrics is the max number of metrics per EMF document, and values per metric.
+	EMFMaxMetrics = 100
+	// EMFMaxDimensions is the max number of dimensions per EMF dimension set.
+	EMFMaxDimensions = 30
+)
+
+type (
+	// EMFConfig configures a Service created by NewEMFService, note that all fields are optional.
+	EMFConfig struct {
+		// Writer defaults to os.Stdout, and will be written to once per document, each of which is terminated by a
+		// newline.
+		Writer io.Writer
+		// Namespace is the CloudWatch namespace, it defaults to "aws-embedded-metrics".
+		Namespace string
+		// NameFunc generates metric names from bucket names, and defaults to using the bucket name as-is, note that
+		// metrics for which it returns an empty name will be dropped.
+		NameFunc func(bucket string) string
+		// Dimensions will be added to every document, e.g. "ServiceName", and will be overridden by any tags with
+		// the same key.
+		Dimensions map[string]string
+		// Interval is the aggregation interval, and how frequently documents will be written, it defaults to 10
+		// seconds, and a negative value disables writing in the background, e.g. for Lambda functions, which should
+		// call Flush before returning.
+		Interval time.Duration
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines (and StatPackets) counts documents.
+		Stats Bucket
+		// ErrorHandler will be called with any errors writing in the background, if it is set.
+		ErrorHandler func(err error)
+	}
+
+	emfService struct {
+		config     EMFConfig
+		stats      *selfStats
+		aggregator aggregator
+		flushMutex sync.Mutex
+		closeOnce  sync.Once
+		stop       chan struct{}
+		done       chan struct{}
+	}
+
+	// emfGroup is the metrics that share a set of dimensions, and therefore documents.
+	emfGroup struct {
+		dimensions []string
+		properties map[string]string
+		metrics    []emfMetric
+	}
+
+	emfMetric struct {
+		name  string
+		unit  string
+		value interface{}
+	}
+
+	emfMetadata struct {
+		Timestamp         int64                `json:"Timestamp"`
+		CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+	}
+
+	emfMetricDirective struct {
+		Namespace  string                `json:"Namespace"`
+		Dimensions [][]string            `json:"Dimensions"`
+		Metrics    []emfMetricDefinition `json:"Metrics"`
+	}
+
+	emfMetricDefinition struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit,omitempty"`
+	}
+)
+
+// NewEMFService returns a Service that aggregates metrics per interval, and writes them as CloudWatch Embedded
+// Metric Format (EMF) JSON documents, e.g. to stdout, for workloads like Lambda functions, where CloudWatch Logs
+// extracts the metrics. The tags of each bucket are declared as dimensions, with multiple values joined by ",", and
+// empty values, and tags with no values, omitted, and any tags in excess of the EMFMaxDimensions limit (in sorted
+// order) are written as properties, which are searchable, but not dimensions.
+//
+// Counts are written as the sum per interval (with the unit "Count"), gauges as the last value, uniques as the
+// number of distinct values (with the unit "Count"), and histograms and timings (with the unit "Milliseconds") as
+// an array of every value. Metrics are split across documents as necessary, to respect the EMFMaxMetrics limit,
+// for both metrics per document and values per metric. Metrics with the same name as a dimension (or property) of
+// the same document, or "_aws", are dropped, with an error returned by Flush, as they would overwrite it.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func NewEMFService(config EMFConfig) Service {
+	if config.Writer == nil {
+		config.Writer = os.Stdout
+	}
+	if config.Namespace == "" {
+		config.Namespace = "aws-embedded-metrics"
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second * 10
+	}
+
+	s := &emfService{
+		config:     config,
+		stats:      newSelfStats(config.Stats),
+		aggregator: aggregator{values: true},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if config.Interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+// Bucket returns a new bucket, keyed by the canonical text encoding of its BucketInfo.
+func (s *emfService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, s.sample)
+}
+
+// Flush writes documents for all metrics aggregated since the last flush, returning the first error.
+func (s *emfService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.flushed(timeNow())
+
+	timestamp := timeNow().UnixNano() / int64(time.Millisecond)
+
+	groups, err := s.groups(s.aggregator.flush())
+	for _, group := range groups {
+		for _, document := range s.documents(group, timestamp) {
+			b, _ := json.Marshal(document)
+			b = append(b, '\n')
+			if _, writeErr := s.config.Writer.Write(b); writeErr != nil {
+				s.stats.error()
+				s.stats.dropped(1)
+				if err == nil {
+					err = fmt.Errorf("appstats.emfService.Flush write error: %s", writeErr.Error())
+				}
+			} else {
+				s.stats.sent(1, len(b))
+			}
+		}
+	}
+
+	return err
+}
+
+// Close stops writing in the background, then flushes.
+func (s *emfService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.Flush()
+}
+
+func (s *emfService) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil && s.config.ErrorHandler != nil {
+				s.config.ErrorHandler(err)
+			}
+		}
+	}
+}
+
+func (s *emfService) sample(sample Sample) {
+	s.aggregator.add(sample)
+}
+
+// groups converts aggregates to metrics, grouped by dimension values, in the order they were first seen, dropping
+// any metrics with a name that is the same as a dimension (or property) of the group, or "_aws", as they are all
+// members of the same document, returning an error for the first.
+func (s *emfService) groups(series []*aggregate) ([]*emfGroup, error) {
+	var (
+		groups []*emfGroup
+		index  = make(map[string]*emfGroup)
+		err    error
+	)
+
+	for _, v := range series {
+		name := v.Info.Bucket
+		if s.config.NameFunc != nil {
+			name = s.config.NameFunc(name)
+		}
+		if name == "" {
+			continue
+		}
+
+		// the key for the group is the tags, which is simplest to derive from the canonical encoding
+		tags := emfDimensionTags(v.Info.Tags)
+		text, _ := BucketInfo{Tags: tags}.MarshalText()
+		group, ok := index[string(text)]
+		if !ok {
+			group = s.group(tags)
+			index[string(text)] = group
+			groups = append(groups, group)
+		}
+
+		if _, ok := group.properties[name]; ok || name == "_aws" {
+			s.stats.error()
+			s.stats.dropped(1)
+			if err == nil {
+				err = fmt.Errorf("appstats.emfService.Flush metric name conflicts with a dimension: %s", name)
+			}
+			continue
+		}
+
+		switch v.Type {
+		case MetricCount, MetricUnique:
+			group.metrics = append(group.metrics, emfMetric{name: name, unit: "Count", value: v.Value()})
+		case MetricGauge:
+			group.metrics = append(group.metrics, emfMetric{name: name, value: v.Value()})
+		default:
+			var unit string
+			if v.Type == MetricTiming {
+				unit = "Milliseconds"
+			}
+			for values := v.Values; len(values) > 0; {
+				n := EMFMaxMetrics
+				if n > len(values) {
+					n = len(values)
+				}
+				group.metrics = append(group.metrics, emfMetric{name: name, unit: unit, value: values[:n]})
+				values = values[n:]
+			}
+		}
+	}
+
+	return groups, err
+}
+
+// emfDimensionTags returns the tags that will become dimensions, omitting empty values, and tags without any values,
+// as CloudWatch rejects empty dimension values.
+func emfDimensionTags(tags map[string][]string) map[string][]string {
+	r := make(map[string][]string, len(tags))
+	for k, v := range tags {
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) != 0 {
+			r[k] = values
+		}
+	}
+	return r
+}
+
+// group initialises a group for the given tags, see emfDimensionTags, merged with the configured dimensions.
+func (s *emfService) group(tags map[string][]string) *emfGroup {
+	properties := make(map[string]string, len(s.config.Dimensions)+len(tags))
+	for k, v := range s.config.Dimensions {
+		properties[k] = v
+	}
+	for k, v := range tags {
+		if len(v) != 0 {
+			properties[k] = strings.Join(v, ",")
+		}
+	}
+
+	dimensions := make([]string, 0, len(properties))
+	for k := range properties {
+		dimensions = append(dimensions, k)
+	}
+	sort.Strings(dimensions)
+	if len(dimensions) > EMFMaxDimensions {
+		dimensions = dimensions[:EMFMaxDimensions]
+	}
+
+	return &emfGroup{
+		dimensions: dimensions,
+		properties: properties,
+	}
+}
+
+// documents packs the metrics of a group into as few documents as possible, without exceeding EMFMaxMetrics per
+// document, or repeating any metric name within a document, as each name is a member of the document.
+func (s *emfService) documents(group *emfGroup, timestamp int64) []map[string]interface{} {
+	var (
+		documents  []map[string]interface{}
+		directives []*emfMetricDirective
+	)
+
+outer:
+	for _, metric := range group.metrics {
+		for i, document := range documents {
+			if _, ok := document[metric.name]; ok || len(directives[i].Metrics) >= EMFMaxMetrics {
+				continue
+			}
+			document[metric.name] = metric.value
+			directives[i].Metrics = append(directives[i].Metrics, emfMetricDefinition{Name: metric.name, Unit: metric.unit})
+			continue outer
+		}
+
+		directive := &emfMetricDirective{
+			Namespace:  s.config.Namespace,
+			Dimensions: [][]string{group.dimensions},
+			Metrics:    []emfMetricDefinition{{Name: metric.name, Unit: metric.unit}},
+		}
+		document := make(map[string]interface{}, len(group.properties)+2)
+		for k, v := range group.properties {
+			document[k] = v
+		}
+		document[metric.name] = metric.value
+		documents = append(documents, document)
+		directives = append(directives, directive)
+	}
+
+	for i, document := range documents {
+		document["_aws"] = emfMetadata{
+			Timestamp:         timestamp,
+			CloudWatchMetrics: []emfMetricDirective{*directives[i]},
+		}
+	}
+
+	return documents
+}
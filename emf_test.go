@@ -0,0 +1,240 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func decodeEMFDocuments(t *testing.T, b []byte) []map[string]interface{} {
+	t.Helper()
+	var documents []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var document map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &document); err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, document)
+	}
+	return documents
+}
+
+func TestEMFService(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 5e6))()
+
+	var b bytes.Buffer
+	s := NewEMFService(EMFConfig{
+		Writer:     &b,
+		Namespace:  "app",
+		Dimensions: map[string]string{"ServiceName": "svc", "env": "default"},
+		Interval:   -1,
+	})
+
+	s.Bucket("requests").Tag("env", "prod").Tag("status", "200").Count(2)
+	s.Bucket("requests").Tag("env", "prod").Tag("status", "200").Increment()
+	s.Bucket("latency").Tag("env", "prod").Tag("status", "200").Timing(time.Millisecond * 20)
+	s.Bucket("latency").Tag("env", "prod").Tag("status", "200").Timing(time.Millisecond * 30)
+	s.Bucket("queue").Tag("region", "a", "b").Tag("empty").Gauge(4)
+	s.Bucket("users").Tag("region", "a", "b").Tag("empty").Unique("x")
+	s.Bucket("size").Histogram(5)
+	s.Bucket("zeros").Tag("blank", "").Increment()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := func(dimensions []interface{}, metrics ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"Timestamp": float64(1500000000005),
+			"CloudWatchMetrics": []interface{}{
+				map[string]interface{}{
+					"Namespace":  "app",
+					"Dimensions": []interface{}{dimensions},
+					"Metrics":    metrics,
+				},
+			},
+		}
+	}
+
+	if diff := deep.Equal(
+		decodeEMFDocuments(t, b.Bytes()),
+		[]map[string]interface{}{
+			{
+				"_aws": metadata(
+					[]interface{}{"ServiceName", "env", "status"},
+					map[string]interface{}{"Name": "latency", "Unit": "Milliseconds"},
+					map[string]interface{}{"Name": "requests", "Unit": "Count"},
+				),
+				"ServiceName": "svc",
+				"env":         "prod",
+				"status":      "200",
+				"latency":     []interface{}{float64(20), float64(30)},
+				"requests":    float64(3),
+			},
+			{
+				"_aws": metadata(
+					[]interface{}{"ServiceName", "env", "region"},
+					map[string]interface{}{"Name": "queue"},
+					map[string]interface{}{"Name": "users", "Unit": "Count"},
+				),
+				"ServiceName": "svc",
+				"env":         "default",
+				"region":      "a,b",
+				"queue":       float64(4),
+				"users":       float64(1),
+			},
+			{
+				"_aws": metadata(
+					[]interface{}{"ServiceName", "env"},
+					map[string]interface{}{"Name": "size"},
+					map[string]interface{}{"Name": "zeros", "Unit": "Count"},
+				),
+				"ServiceName": "svc",
+				"env":         "default",
+				"size":        []interface{}{float64(5)},
+				"zeros":       float64(1),
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestEMFService_limits(t *testing.T) {
+	var b bytes.Buffer
+	s := NewEMFService(EMFConfig{
+		Writer:   &b,
+		Interval: -1,
+	})
+
+	bucket := s.Bucket("metric")
+	for i := 0; i < EMFMaxDimensions+2; i++ {
+		bucket = bucket.Tag(fmt.Sprintf("tag_%02d", i), "v")
+	}
+	for i := 0; i < EMFMaxMetrics+1; i++ {
+		bucket.Histogram(i)
+		s.Bucket(fmt.Sprintf("count_%03d", i)).Increment()
+	}
+	bucket.Increment()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	documents := decodeEMFDocuments(t, b.Bytes())
+
+	var summary []string
+	for _, document := range documents {
+		directive := document["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		dimensions := directive["Dimensions"].([]interface{})[0].([]interface{})
+		metrics := directive["Metrics"].([]interface{})
+		var values int
+		if v, ok := document["metric"].([]interface{}); ok {
+			values = len(v)
+		}
+		summary = append(summary, fmt.Sprintf("dimensions=%d metrics=%d values=%d tag_31=%v", len(dimensions), len(metrics), values, document["tag_31"]))
+	}
+
+	if diff := deep.Equal(
+		summary,
+		[]string{
+			"dimensions=0 metrics=100 values=0 tag_31=<nil>",
+			"dimensions=0 metrics=1 values=0 tag_31=<nil>",
+			"dimensions=30 metrics=1 values=0 tag_31=v",
+			"dimensions=30 metrics=1 values=100 tag_31=v",
+			"dimensions=30 metrics=1 values=1 tag_31=v",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+type emfErrorWriter struct{}
+
+func (emfErrorWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("some error")
+}
+
+func TestEMFService_writeError(t *testing.T) {
+	s := NewEMFService(EMFConfig{
+		Writer:   emfErrorWriter{},
+		Interval: -1,
+	})
+	s.Bucket("a").Increment()
+	if err := s.Flush(); err == nil || err.Error() != "appstats.emfService.Flush write error: some error" {
+		t.Error("unexpected err", err)
+	}
+}
+
+func TestEMFService_nameConflict(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 0))()
+
+	var b bytes.Buffer
+	stats, samples := newTestStatsBucket()
+	s := NewEMFService(EMFConfig{
+		Writer:     &b,
+		Dimensions: map[string]string{"ServiceName": "svc"},
+		Interval:   -1,
+		Stats:      stats,
+	})
+
+	s.Bucket("region").Tag("region", "a").Increment()
+	s.Bucket("ServiceName").Increment()
+	s.Bucket("_aws").Increment()
+	s.Bucket("requests").Tag("region", "a").Increment()
+
+	if err := s.Flush(); err == nil || err.Error() != "appstats.emfService.Flush metric name conflicts with a dimension: ServiceName" {
+		t.Error("unexpected err", err)
+	}
+
+	documents := decodeEMFDocuments(t, b.Bytes())
+	if len(documents) != 1 {
+		t.Fatal(documents)
+	}
+	if diff := deep.Equal(
+		[]interface{}{documents[0]["region"], documents[0]["ServiceName"], documents[0]["requests"]},
+		[]interface{}{"a", "svc", float64(1)},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples()[:6],
+		[]string{
+			"stats,stat=errors count 1",
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=drops count 1",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"strings"
+	"unicode"
+)
+
+var (
+	graphiteSegmentSanitiser = NewSanitiser(
+		SanitiserMaxLength(255),
+		SanitiserAllowed(AnyRuneClass(unicode.IsLetter, unicode.IsNumber, RuneClassOf("_-"))),
+		SanitiserReplacement('_'),
+		SanitiserCollapse(),
+	)
+
+	graphiteTagKeySanitiser = NewSanitiser(
+		SanitiserAllowed(func(r rune) bool {
+			return isGraphiteTagRune(r) && !strings.ContainsRune(";!^=", r)
+		}),
+		SanitiserReplacement('_'),
+		SanitiserCollapse(),
+	)
+
+	graphiteTagValueSanitiser = NewSanitiser(
+		SanitiserLeading(func(r rune) bool {
+			return isGraphiteTagRune(r) && !strings.ContainsRune(";~", r)
+		}),
+		SanitiserAllowed(func(r rune) bool {
+			return isGraphiteTagRune(r) && r != ';'
+		}),
+		SanitiserReplacement('_'),
+		SanitiserCollapse(),
+	)
+
+	graphiteTaggedBucketKeyFormat = bucketKeyFormat{
+		first:  ";",
+		next:   ";",
+		assign: "=",
+	}
+)
+
+// NewGraphiteTaggedBucketKeyFunc returns a key func generating Graphite tagged series, like "some.path;tag1=a;tag2=b",
+// using GraphiteKeySanitisers, note that the default TagValuesFunc is still TagValuesLast, as Graphite doesn't
+// support repeated tags, and that empty values are omitted, as they are not supported.
+// https://graphite.readthedocs.io/en/latest/tags.html
+func NewGraphiteTaggedBucketKeyFunc(opts ...BucketKeyOption) BucketKeyFunc {
+	return newBucketKeyFunc(graphiteTaggedBucketKeyFormat, GraphiteKeySanitisers(), opts...)
+}
+
+// NewGraphitePathBucketKeyFunc returns a key func generating plain Graphite dotted paths, sanitising the bucket
+// using SanitiseGraphitePath, and folding each tag into the path as a key segment followed by a value segment, both
+// sanitised using SanitiseGraphiteSegment, e.g. "some.path.env.prod.host.a". Tags are folded in the order specified
+// by tagOrder (sanitised keys), with any remaining tags following in sorted order, and repeated values (depending on
+// the TagValuesFunc) will result in multiple value segments.
+func NewGraphitePathBucketKeyFunc(tagOrder []string, opts ...BucketKeyOption) BucketKeyFunc {
+	var (
+		c          = newBucketKeyConfig(opts...)
+		sanitisers = KeySanitisers{
+			Bucket:   SanitiseGraphitePath,
+			TagKey:   SanitiseGraphiteSegment,
+			TagValue: SanitiseGraphiteSegment,
+		}
+		order = make(map[string]int, len(tagOrder))
+	)
+
+	for i, tag := range tagOrder {
+		if tag = SanitiseGraphiteSegment(tag); tag != "" {
+			if _, ok := order[tag]; !ok {
+				order[tag] = i
+			}
+		}
+	}
+
+	return func(info BucketInfo) (string, bool) {
+		path := SanitiseGraphitePath(info.Bucket)
+		if path == "" {
+			return "", false
+		}
+
+		tags, values, ok := c.tags(info, sanitisers)
+		if !ok {
+			return "", false
+		}
+
+		segments := make([]string, 1, 1+len(tags)*2)
+		segments[0] = path
+
+		ordered := make([]string, len(tagOrder))
+		for _, tag := range tags {
+			if i, ok := order[tag]; ok {
+				ordered[i] = tag
+			}
+		}
+		for _, tag := range ordered {
+			if tag != "" {
+				segments = append(segments, tag)
+				segments = append(segments, values[tag]...)
+			}
+		}
+		for _, tag := range tags {
+			if _, ok := order[tag]; !ok {
+				segments = append(segments, tag)
+				segments = append(segments, values[tag]...)
+			}
+		}
+
+		return strings.Join(segments, "."), true
+	}
+}
+
+// GraphiteKeySanitisers returns the sanitisers used by NewGraphiteTaggedBucketKeyFunc, which are
+// SanitiseGraphitePath, SanitiseGraphiteTagKey, and SanitiseGraphiteTagValue.
+func GraphiteKeySanitisers() KeySanitisers {
+	return KeySanitisers{
+		Bucket:   SanitiseGraphitePath,
+		TagKey:   SanitiseGraphiteTagKey,
+		TagValue: SanitiseGraphiteTagValue,
+	}
+}
+
+// SanitiseGraphiteSegment sanitises a single Graphite path segment, allowing letters, numbers, `_` and `-`, and
+// replacing any other runes, including `.`, with a single '_', and limiting the length to 255 bytes.
+func SanitiseGraphiteSegment(value string) string {
+	return graphiteSegmentSanitiser(value)
+}
+
+// SanitiseGraphitePath sanitises a dotted Graphite path, treating `.` as a separator, by sanitising each segment
+// using SanitiseGraphiteSegment, and removing any empty segments.
+func SanitiseGraphitePath(value string) string {
+	segments := strings.Split(value, ".")
+	n := 0
+	for _, segment := range segments {
+		if segment = SanitiseGraphiteSegment(segment); segment != "" {
+			segments[n] = segment
+			n++
+		}
+	}
+	return strings.Join(segments[:n], ".")
+}
+
+// SanitiseGraphiteTagKey sanitises a Graphite tag key, replacing any of `;!^=`, as well as whitespace and any
+// non-printable or non-ASCII runes, with a single '_'.
+func SanitiseGraphiteTagKey(value string) string {
+	return graphiteTagKeySanitiser(value)
+}
+
+// SanitiseGraphiteTagValue sanitises a Graphite tag value, replacing `;`, as well as whitespace and any
+// non-printable or non-ASCII runes, with a single '_', and dropping any leading runes that are invalid, or `~`.
+func SanitiseGraphiteTagValue(value string) string {
+	return graphiteTagValueSanitiser(value)
+}
+
+// isGraphiteTagRune returns true for printable ASCII runes, excluding spaces, which would break the plaintext
+// protocol.
+func isGraphiteTagRune(r rune) bool {
+	return r > ' ' && r < unicode.MaxASCII
+}
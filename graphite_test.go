@@ -0,0 +1,149 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSanitiseGraphite(t *testing.T) {
+	testCases := []struct {
+		Sanitiser func(value string) string
+		Input     string
+		Output    string
+	}{
+		{Sanitiser: SanitiseGraphiteSegment, Input: "a.b c/d", Output: "a_b_c_d"},
+		{Sanitiser: SanitiseGraphiteSegment, Input: "Us-East-1", Output: "Us-East-1"},
+		{Sanitiser: SanitiseGraphitePath, Input: "..a.b c..d/e.", Output: "a.b_c.d_e"},
+		{Sanitiser: SanitiseGraphitePath, Input: "...", Output: ""},
+		{Sanitiser: SanitiseGraphiteTagKey, Input: "a;b!c^d=e f.g", Output: "a_b_c_d_e_f.g"},
+		{Sanitiser: SanitiseGraphiteTagValue, Input: "~~a;b~c=d e", Output: "a_b~c=d_e"},
+		{Sanitiser: SanitiseGraphiteTagValue, Input: "ñ", Output: ""},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSanitiseGraphite_#%d", i+1)
+
+		output := testCase.Sanitiser(testCase.Input)
+
+		if output != testCase.Output {
+			t.Error(name, "output", "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestNewGraphiteTaggedBucketKeyFunc(t *testing.T) {
+	testCases := []struct {
+		Info BucketInfo
+		Key  string
+		Ok   bool
+	}{
+		{
+			Info: BucketInfo{Bucket: "."},
+			Ok:   false,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: "http.requests",
+				Tags: map[string][]string{
+					"status": {"404", "200"},
+					"env":    {"prod"},
+					"empty":  {"~"},
+				},
+			},
+			Key: "http.requests;env=prod;status=200",
+			Ok:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewGraphiteTaggedBucketKeyFunc_#%d", i+1)
+
+		key, ok := NewGraphiteTaggedBucketKeyFunc()(testCase.Info)
+
+		if key != testCase.Key {
+			t.Error(name, "key", "expected =", testCase.Key, "actual =", key)
+		}
+
+		if ok != testCase.Ok {
+			t.Error(name, "ok", "expected =", testCase.Ok, "actual =", ok)
+		}
+	}
+}
+
+func TestNewGraphiteTaggedBucketKeyFunc_parse(t *testing.T) {
+	key, ok := NewGraphiteTaggedBucketKeyFunc()(BucketInfo{Bucket: "a.b", Tags: map[string][]string{"c": {"d"}}})
+	if !ok {
+		t.Fatal(key)
+	}
+	info, err := ParseGraphiteBucketKey(key)
+	if err != nil || !info.Equal(BucketInfo{Bucket: "a.b", Tags: map[string][]string{"c": {"d"}}}) {
+		t.Error(info, err)
+	}
+}
+
+func TestNewGraphitePathBucketKeyFunc(t *testing.T) {
+	info := BucketInfo{
+		Bucket: "http.requests",
+		Tags: map[string][]string{
+			"status": {"404", "200"},
+			"env":    {"prod"},
+			"host":   {"a.example.com"},
+			"empty":  {""},
+			"zone":   {"b"},
+		},
+	}
+
+	testCases := []struct {
+		Order []string
+		Opts  []BucketKeyOption
+		Key   string
+	}{
+		{
+			Key: "http.requests.env.prod.host.a_example_com.status.200.zone.b",
+		},
+		{
+			Order: []string{"zone", "missing", "host", "zone", "", "empty"},
+			Key:   "http.requests.zone.b.host.a_example_com.env.prod.status.200",
+		},
+		{
+			Order: []string{"status"},
+			Opts:  []BucketKeyOption{BucketKeyTagValues(TagValuesAll)},
+			Key:   "http.requests.status.404.200.env.prod.host.a_example_com.zone.b",
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewGraphitePathBucketKeyFunc_#%d", i+1)
+
+		key, ok := NewGraphitePathBucketKeyFunc(testCase.Order, testCase.Opts...)(info)
+
+		if key != testCase.Key || !ok {
+			t.Error(name, "key", "expected =", testCase.Key, "actual =", key, ok)
+		}
+	}
+
+	if key, ok := NewGraphitePathBucketKeyFunc(nil)(BucketInfo{Bucket: "..."}); key != "" || ok {
+		t.Error(key, ok)
+	}
+
+	if key, ok := NewGraphitePathBucketKeyFunc(nil, BucketKeyTagValues(TagValuesSingle))(info); key != "" || ok {
+		t.Error(key, ok)
+	}
+}
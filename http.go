@@ -0,0 +1,94 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type (
+	// httpSender sends request bodies, retrying with exponential backoff, used by the Service implementations that
+	// submit metrics over HTTP.
+	httpSender struct {
+		client     *http.Client
+		maxRetries int
+		backoff    time.Duration
+	}
+)
+
+// send sends body, retrying any network errors, or responses with status 429, 502, 503, or 504, with the delay
+// between attempts starting at backoff, and doubling each time, returning nil on any 2xx status.
+func (h httpSender) send(method, url string, header http.Header, body []byte) error {
+	client := h.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	delay := h.backoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := h.attempt(client, method, url, header, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= h.maxRetries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (h httpSender) attempt(client *http.Client, method, url string, header http.Header, body []byte) (bool, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	// the body is read (up to a limit) to allow connection reuse, and to provide context for errors
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("%s %s status %d: %s", method, url, res.StatusCode, strings.TrimSpace(string(b)))
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, err
+	default:
+		return false, err
+	}
+}
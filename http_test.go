@@ -0,0 +1,114 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPSender_send(t *testing.T) {
+	testCases := []struct {
+		Statuses   []int
+		MaxRetries int
+		Calls      int
+		Err        bool
+	}{
+		{
+			Statuses: []int{http.StatusOK},
+			Calls:    1,
+		},
+		{
+			Statuses: []int{http.StatusAccepted},
+			Calls:    1,
+		},
+		{
+			Statuses: []int{http.StatusServiceUnavailable},
+			Calls:    1,
+			Err:      true,
+		},
+		{
+			Statuses:   []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			MaxRetries: 2,
+			Calls:      3,
+		},
+		{
+			Statuses:   []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout},
+			MaxRetries: 2,
+			Calls:      3,
+			Err:        true,
+		},
+		{
+			Statuses:   []int{http.StatusBadRequest, http.StatusOK},
+			MaxRetries: 2,
+			Calls:      1,
+			Err:        true,
+		},
+	}
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestHTTPSender_send_#%d", i+1)
+
+		var calls int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut {
+				t.Error(name, "unexpected method", r.Method)
+			}
+			if v := r.Header.Get("X-Test"); v != "value" {
+				t.Error(name, "unexpected header", v)
+			}
+			if b, err := ioutil.ReadAll(r.Body); err != nil || string(b) != "body" {
+				t.Error(name, "unexpected body", string(b), err)
+			}
+			w.WriteHeader(testCase.Statuses[calls])
+			calls++
+		}))
+
+		err := httpSender{
+			client:     server.Client(),
+			maxRetries: testCase.MaxRetries,
+			backoff:    time.Millisecond,
+		}.send(
+			http.MethodPut,
+			server.URL,
+			http.Header{"X-Test": {"value"}},
+			[]byte("body"),
+		)
+
+		server.Close()
+
+		if (err != nil) != testCase.Err {
+			t.Error(name, "unexpected err", err)
+		}
+		if calls != testCase.Calls {
+			t.Error(name, "unexpected calls", calls)
+		}
+	}
+}
+
+func TestHTTPSender_send_networkError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+	if err := (httpSender{maxRetries: 1, backoff: time.Millisecond}).send(http.MethodPost, url, nil, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
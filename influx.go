@@ -0,0 +1,73 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"strings"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`,`, `\,`,
+		` `, `\ `,
+		"\n", `\ `,
+		"\r", `\ `,
+	)
+	influxTagEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`,`, `\,`,
+		`=`, `\=`,
+		` `, `\ `,
+		"\n", `\ `,
+		"\r", `\ `,
+	)
+)
+
+// NewInfluxBucketKeyFunc returns a key func with the same output format as DefaultBucketKeyFunc, that instead of
+// sanitising the bucket, tag keys, and tag values, escapes them according to the InfluxDB line protocol, see
+// EscapeInfluxMeasurement and EscapeInfluxTag, which means that values like "200" or "us-east-1" will be preserved.
+// Note that empty tag values are not supported by InfluxDB, and will be omitted, and that the default TagValuesFunc
+// is still TagValuesLast, as InfluxDB doesn't support repeated tags, see also ParseInfluxBucketKey.
+// https://docs.influxdata.com/influxdb/v1.4/write_protocols/line_protocol_reference/#special-characters
+func NewInfluxBucketKeyFunc(opts ...BucketKeyOption) BucketKeyFunc {
+	return NewBucketKeyFuncSanitisers(InfluxKeySanitisers(), opts...)
+}
+
+// InfluxKeySanitisers returns the (escaping) sanitisers used by NewInfluxBucketKeyFunc.
+func InfluxKeySanitisers() KeySanitisers {
+	return KeySanitisers{
+		Bucket:   EscapeInfluxMeasurement,
+		TagKey:   EscapeInfluxTag,
+		TagValue: EscapeInfluxTag,
+	}
+}
+
+// EscapeInfluxMeasurement escapes commas and spaces with a backslash, as required for an InfluxDB measurement, as
+// well as backslashes, so a value like `C:\` cannot escape the following delimiter, note that newlines cannot be
+// represented, and are replaced with (escaped) spaces.
+func EscapeInfluxMeasurement(value string) string {
+	return influxMeasurementEscaper.Replace(value)
+}
+
+// EscapeInfluxTag escapes commas, equals signs, and spaces with a backslash, as required for InfluxDB tag keys and
+// values, as well as backslashes, see EscapeInfluxMeasurement, note that newlines cannot be represented, and are
+// replaced with (escaped) spaces.
+func EscapeInfluxTag(value string) string {
+	return influxTagEscaper.Replace(value)
+}
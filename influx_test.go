@@ -0,0 +1,137 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"github.com/go-test/deep"
+	"testing"
+)
+
+func TestNewInfluxBucketKeyFunc(t *testing.T) {
+	testCases := []struct {
+		Opts []BucketKeyOption
+		Info BucketInfo
+		Key  string
+		Ok   bool
+	}{
+		{
+			Info: BucketInfo{},
+			Key:  "",
+			Ok:   false,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: "http.requests",
+				Tags: map[string][]string{
+					"status":  {"200"},
+					"class":   {"2xx"},
+					"region":  {"us-east-1"},
+					"empty":   {""},
+					"missing": nil,
+				},
+			},
+			Key: "http.requests,class=2xx,region=us-east-1,status=200",
+			Ok:  true,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: "my bucket,name=x",
+				Tags: map[string][]string{
+					"tag key,=": {"a, b=c", "Last Value"},
+					"newline":   {"a\nb"},
+				},
+			},
+			Key: `my\ bucket\,name=x,newline=a\ b,tag\ key\,\==Last\ Value`,
+			Ok:  true,
+		},
+		{
+			Opts: []BucketKeyOption{BucketKeyTagValues(TagValuesJoin("|"))},
+			Info: BucketInfo{
+				Bucket: "bucket",
+				Tags: map[string][]string{
+					"code": {"404", "500"},
+				},
+			},
+			Key: "bucket,code=404|500",
+			Ok:  true,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: `m\`,
+				Tags: map[string][]string{
+					"path": {`C:\`},
+					"z":    {"1"},
+				},
+			},
+			Key: `m\\,path=C:\\,z=1`,
+			Ok:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewInfluxBucketKeyFunc_#%d", i+1)
+
+		key, ok := NewInfluxBucketKeyFunc(testCase.Opts...)(testCase.Info)
+
+		if key != testCase.Key {
+			t.Error(name, "key", "expected =", testCase.Key, "actual =", key)
+		}
+
+		if ok != testCase.Ok {
+			t.Error(name, "ok", "expected =", testCase.Ok, "actual =", ok)
+		}
+	}
+}
+
+func TestNewInfluxBucketKeyFunc_parse(t *testing.T) {
+	testCases := []BucketInfo{
+		{
+			Bucket: "my bucket,name=x",
+			Tags: map[string][]string{
+				"status":    {"200"},
+				"tag key,=": {"a, b=c"},
+			},
+		},
+		{
+			Bucket: `m\`,
+			Tags: map[string][]string{
+				"path": {`C:\`},
+				`a\b`:  {`\,\=\ \\`},
+				"z":    {"1"},
+				`end\`: {`x`},
+			},
+		},
+	}
+
+	for i, expected := range testCases {
+		name := fmt.Sprintf("TestNewInfluxBucketKeyFunc_parse_#%d", i+1)
+
+		key, ok := NewInfluxBucketKeyFunc()(expected)
+		if !ok {
+			t.Fatal(name, key)
+		}
+		info, err := ParseInfluxBucketKey(key)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if diff := deep.Equal(info, expected); diff != nil {
+			t.Error(name, key, diff)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// MetricMetadata describes a metric, identified by its bucket name, for the purposes of documentation (see
+	// MetadataRegistry), and for backends that support it, e.g. the Prometheus HELP line, or the OpenTelemetry unit.
+	MetricMetadata struct {
+		// Name is the bucket name, i.e. BucketInfo.Bucket, prior to any sanitisation.
+		Name string `json:"name"`
+		// Type is the expected type, and is optional.
+		Type MetricType `json:"type,omitempty"`
+		// Unit is the unit of the values, ideally per UCUM, e.g. "By" or "s", note that it will be ignored for
+		// timings, which always use milliseconds (or seconds, for Prometheus).
+		Unit string `json:"unit,omitempty"`
+		// Description is a human readable description, e.g. "The number of requests received.".
+		Description string `json:"description,omitempty"`
+		// Owner is the team or person responsible for the metric.
+		Owner string `json:"owner,omitempty"`
+		// TagKeys is the expected tag keys, and is used only for documentation.
+		TagKeys []string `json:"tagKeys,omitempty"`
+	}
+
+	// MetadataRegistry is a catalogue of MetricMetadata, keyed by name, which may be exported as JSON (it implements
+	// json.Marshaler) or Markdown, and provided to the configs that support it, e.g. PushgatewayConfig.Metadata.
+	// Note that a nil registry is valid, and contains nothing, that the zero value is ready to use, and that it is
+	// safe for concurrent use.
+	MetadataRegistry struct {
+		mutex   sync.RWMutex
+		metrics map[string]MetricMetadata
+	}
+
+	strictService struct {
+		service      Service
+		registry     *MetadataRegistry
+		onUndeclared func(err error)
+	}
+)
+
+// NewMetadataRegistry returns a new registry, registering metadata, note that it will panic if Register fails.
+func NewMetadataRegistry(metadata ...MetricMetadata) *MetadataRegistry {
+	r := &MetadataRegistry{
+		metrics: make(map[string]MetricMetadata),
+	}
+	if err := r.Register(metadata...); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Register adds metadata to the registry, returning an error if any has an empty name, or if a different value was
+// already registered with the same name, in which case nothing will be registered. Registering an identical value
+// more than once is allowed, e.g. in the init of multiple packages.
+func (r *MetadataRegistry) Register(metadata ...MetricMetadata) error {
+	metadata = append([]MetricMetadata(nil), metadata...)
+	for i := range metadata {
+		if len(metadata[i].TagKeys) == 0 {
+			metadata[i].TagKeys = nil
+		} else {
+			metadata[i].TagKeys = append([]string(nil), metadata[i].TagKeys...)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.metrics == nil {
+		r.metrics = make(map[string]MetricMetadata)
+	}
+
+	for i, v := range metadata {
+		if v.Name == "" {
+			return errors.New("appstats.MetadataRegistry.Register empty name")
+		}
+		existing, ok := r.metrics[v.Name]
+		if !ok {
+			for _, other := range metadata[:i] {
+				if other.Name == v.Name {
+					existing, ok = other, true
+					break
+				}
+			}
+		}
+		if ok && !reflect.DeepEqual(existing, v) {
+			return fmt.Errorf("appstats.MetadataRegistry.Register conflicting metadata: %s", v.Name)
+		}
+	}
+
+	for _, v := range metadata {
+		r.metrics[v.Name] = v
+	}
+
+	return nil
+}
+
+// Lookup returns the metadata registered with name, if any.
+func (r *MetadataRegistry) Lookup(name string) (MetricMetadata, bool) {
+	if r == nil {
+		return MetricMetadata{}, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	v, ok := r.metrics[name]
+	if ok && v.TagKeys != nil {
+		v.TagKeys = append([]string(nil), v.TagKeys...)
+	}
+	return v, ok
+}
+
+// Metrics returns a copy of all the registered metadata, sorted by name.
+func (r *MetadataRegistry) Metrics() []MetricMetadata {
+	if r == nil {
+		return nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	metrics := make([]MetricMetadata, 0, len(r.metrics))
+	for _, v := range r.metrics {
+		if v.TagKeys != nil {
+			v.TagKeys = append([]string(nil), v.TagKeys...)
+		}
+		metrics = append(metrics, v)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// MarshalJSON encodes the registry as a JSON array of every MetricMetadata, sorted by name.
+func (r *MetadataRegistry) MarshalJSON() ([]byte, error) {
+	metrics := r.Metrics()
+	if metrics == nil {
+		metrics = []MetricMetadata{}
+	}
+	return json.Marshal(metrics)
+}
+
+// WriteMarkdown writes the registry as a Markdown table, with a row for every MetricMetadata, sorted by name.
+func (r *MetadataRegistry) WriteMarkdown(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("| Name | Type | Unit | Description | Owner | Tags |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for _, v := range r.Metrics() {
+		var metricType string
+		if v.Type != 0 {
+			metricType = v.Type.String()
+		}
+		tagKeys := make([]string, len(v.TagKeys))
+		for i, k := range v.TagKeys {
+			tagKeys[i] = "`" + k + "`"
+		}
+		for i, cell := range []string{
+			"`" + v.Name + "`",
+			metricType,
+			v.Unit,
+			v.Description,
+			v.Owner,
+			strings.Join(tagKeys, ", "),
+		} {
+			if i != 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString("| ")
+			b.WriteString(markdownCellReplacer.Replace(cell))
+		}
+		b.WriteString(" |\n")
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("appstats.MetadataRegistry.WriteMarkdown write error: %s", err.Error())
+	}
+	return nil
+}
+
+var markdownCellReplacer = strings.NewReplacer(`|`, `\|`, "\r\n", " ", "\n", " ", "\r", " ")
+
+// NewStrictService wraps service, enforcing the registry, by rejecting any bucket with a name that was not
+// registered at the time Service.Bucket was called, which will be passed to onUndeclared as an error, and replaced
+// with a bucket that drops everything (and is not Enabled). If onUndeclared is nil, Bucket will panic instead, which
+// is useful in tests, note that it will also panic if service or registry are nil. Tags are not checked.
+func NewStrictService(service Service, registry *MetadataRegistry, onUndeclared func(err error)) Service {
+	if service == nil {
+		panic(errors.New("appstats.NewStrictService nil service"))
+	}
+	if registry == nil {
+		panic(errors.New("appstats.NewStrictService nil registry"))
+	}
+	return &strictService{
+		service:      service,
+		registry:     registry,
+		onUndeclared: onUndeclared,
+	}
+}
+
+// Bucket returns the bucket from the wrapped service, if the name was registered, see NewStrictService.
+func (s *strictService) Bucket(bucket interface{}) Bucket {
+	name := fmt.Sprint(bucket)
+	if _, ok := s.registry.Lookup(name); ok {
+		return s.service.Bucket(bucket)
+	}
+	err := fmt.Errorf("appstats.strictService.Bucket undeclared bucket: %s", name)
+	if s.onUndeclared == nil {
+		panic(err)
+	}
+	s.onUndeclared(err)
+	return NewBucket(bucket, func(info BucketInfo) (string, bool) { return "", false }, func(sample Sample) {})
+}
+
+// Flush flushes the wrapped service.
+func (s *strictService) Flush() error {
+	return s.service.Flush()
+}
+
+// Close closes the wrapped service.
+func (s *strictService) Close() error {
+	return s.service.Close()
+}
+
+// Enabled returns the result of Enabled for the wrapped service.
+func (s *strictService) Enabled() bool {
+	return Enabled(s.service)
+}
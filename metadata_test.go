@@ -0,0 +1,206 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("some_error")
+}
+
+func TestMetadataRegistry(t *testing.T) {
+	var nilRegistry *MetadataRegistry
+	if _, ok := nilRegistry.Lookup("a"); ok {
+		t.Error("expected not ok")
+	}
+	if b, err := json.Marshal(nilRegistry); err != nil || string(b) != "null" {
+		t.Error(string(b), err)
+	}
+
+	tagKeys := []string{"status", "method"}
+
+	r := NewMetadataRegistry(
+		MetricMetadata{
+			Name:        "http.requests",
+			Type:        MetricCount,
+			Description: "The number of requests | by status.\nSee the docs.",
+			Owner:       "platform",
+			TagKeys:     tagKeys,
+		},
+		MetricMetadata{
+			Name: "http.latency",
+			Type: MetricTiming,
+			Unit: "ms",
+		},
+	)
+
+	// the tag keys are copied
+	tagKeys[0] = "modified"
+
+	if err := r.Register(MetricMetadata{Name: "http.latency", Type: MetricTiming, Unit: "ms", TagKeys: []string{}}); err != nil {
+		t.Error(err)
+	}
+	if err := r.Register(MetricMetadata{Name: "queue"}, MetricMetadata{}); err == nil || err.Error() != "appstats.MetadataRegistry.Register empty name" {
+		t.Error(err)
+	}
+	if err := r.Register(MetricMetadata{Name: "http.latency", Type: MetricHistogram}); err == nil || err.Error() != "appstats.MetadataRegistry.Register conflicting metadata: http.latency" {
+		t.Error(err)
+	}
+	if err := r.Register(MetricMetadata{Name: "queue"}, MetricMetadata{Name: "queue", Unit: "1"}); err == nil || err.Error() != "appstats.MetadataRegistry.Register conflicting metadata: queue" {
+		t.Error(err)
+	}
+	if _, ok := r.Lookup("queue"); ok {
+		t.Error("expected nothing to be registered")
+	}
+
+	if v, ok := r.Lookup("http.requests"); !ok || v.Owner != "platform" || fmt.Sprint(v.TagKeys) != "[status method]" {
+		t.Error(v, ok)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(
+		string(b),
+		`[{"name":"http.latency","type":"timing","unit":"ms"},{"name":"http.requests","type":"count","description":"The number of requests | by status.\nSee the docs.","owner":"platform","tagKeys":["status","method"]}]`,
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	var metrics []MetricMetadata
+	if err := json.Unmarshal(b, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(metrics, r.Metrics()); diff != nil {
+		t.Error(diff)
+	}
+
+	var markdown bytes.Buffer
+	if err := r.WriteMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(
+		markdown.String(),
+		"| Name | Type | Unit | Description | Owner | Tags |\n"+
+			"| --- | --- | --- | --- | --- | --- |\n"+
+			"| `http.latency` | timing | ms |  |  |  |\n"+
+			"| `http.requests` | count |  | The number of requests \\| by status. See the docs. | platform | `status`, `method` |\n",
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := r.WriteMarkdown(errWriter{}); err == nil || err.Error() != "appstats.MetadataRegistry.WriteMarkdown write error: some_error" {
+		t.Error(err)
+	}
+
+	// the zero value is usable
+	var zero MetadataRegistry
+	if err := zero.Register(MetricMetadata{Name: "a"}); err != nil {
+		t.Error(err)
+	}
+	if _, ok := zero.Lookup("a"); !ok {
+		t.Error("expected ok")
+	}
+}
+
+func TestNewMetadataRegistry_panic(t *testing.T) {
+	defer func() {
+		if r := fmt.Sprint(recover()); r != "appstats.MetadataRegistry.Register empty name" {
+			t.Error(r)
+		}
+	}()
+	NewMetadataRegistry(MetricMetadata{})
+}
+
+func TestNewStrictService(t *testing.T) {
+	inner := &recordingService{}
+	registry := NewMetadataRegistry(MetricMetadata{Name: "a"})
+
+	var errs []string
+	s := NewStrictService(inner, registry, func(err error) {
+		errs = append(errs, err.Error())
+	})
+
+	s.Bucket("a").Tag("k", "v").Increment()
+	if b := s.Bucket("b"); Enabled(b) {
+		t.Error("expected disabled")
+	} else {
+		b.Increment()
+	}
+
+	// registered later
+	if err := registry.Register(MetricMetadata{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Bucket("b").Increment()
+
+	if !Enabled(s) {
+		t.Error("expected enabled")
+	}
+	if err := s.Flush(); err != nil {
+		t.Error(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if diff := deep.Equal(inner.take(), []string{"a,k=v count 1", "b count 1"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(errs, []string{"appstats.strictService.Bucket undeclared bucket: b"}); diff != nil {
+		t.Error(diff)
+	}
+
+	func() {
+		defer func() {
+			if r := fmt.Sprint(recover()); r != "appstats.strictService.Bucket undeclared bucket: c" {
+				t.Error(r)
+			}
+		}()
+		NewStrictService(inner, registry, nil).Bucket("c")
+	}()
+
+	func() {
+		defer func() {
+			if r := fmt.Sprint(recover()); r != "appstats.NewStrictService nil service" {
+				t.Error(r)
+			}
+		}()
+		NewStrictService(nil, registry, nil)
+	}()
+
+	func() {
+		defer func() {
+			if r := fmt.Sprint(recover()); r != "appstats.NewStrictService nil registry" {
+				t.Error(r)
+			}
+		}()
+		NewStrictService(inner, nil, nil)
+	}()
+}
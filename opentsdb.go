@@ -0,0 +1,460 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	openTSDBSanitiser = NewSanitiser(
+		SanitiserAllowed(AnyRuneClass(unicode.IsLetter, isASCIIDigit, RuneClassOf("-_./"))),
+		SanitiserReplacement('_'),
+		SanitiserCollapse(),
+	)
+
+	openTSDBBucketKeyFormat = bucketKeyFormat{
+		first:  " ",
+		next:   " ",
+		assign: "=",
+	}
+)
+
+type (
+	// OpenTSDBConfig configures a Service created by NewOpenTSDBService, note that either Address or URL is
+	// required, and that DefaultTags is recommended, e.g. "host".
+	OpenTSDBConfig struct {
+		// Address is the address of the telnet-style API, e.g. "localhost:4242", and is ignored if URL is set.
+		Address string
+		// Network defaults to "tcp".
+		Network string
+		// Dial may be used to override net.Dial.
+		Dial func(network, address string) (net.Conn, error)
+		// WriteTimeout is the deadline for each write to Address, it defaults to 10 seconds.
+		WriteTimeout time.Duration
+		// URL enables the HTTP API, instead of the telnet-style API, e.g. "http://localhost:4242/api/put".
+		URL string
+		// Client defaults to http.DefaultClient.
+		Client *http.Client
+		// Header will be added to each request to URL.
+		Header http.Header
+		// BatchSize is the max number of datapoints per request to URL, it defaults to 50.
+		BatchSize int
+		// MaxRetries is the max number of times a failed request to URL will be retried, it defaults to 3, and a
+		// negative value disables retries.
+		MaxRetries int
+		// RetryBackoff is the delay before the first retry, which doubles for each retry, it defaults to 1 second.
+		RetryBackoff time.Duration
+		// DefaultTags will be added to every bucket, but will not override any tags of the bucket.
+		DefaultTags map[string]string
+		// KeyFunc defaults to NewOpenTSDBBucketKeyFunc(), and must generate keys in the same format.
+		KeyFunc BucketKeyFunc
+		// Interval is the aggregation interval for counts (and uniques), and how frequently datapoints will be
+		// flushed, it defaults to 10 seconds, and a negative value disables flushing in the background.
+		Interval time.Duration
+		// MaxPending is the max number of datapoints that will be buffered, after which the oldest will be dropped,
+		// it defaults to 10000.
+		MaxPending int
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines counts datapoints, and StatQueueDepth is the number of pending datapoints.
+		Stats Bucket
+		// ErrorHandler will be called with any errors flushing in the background, if it is set.
+		ErrorHandler func(err error)
+	}
+
+	openTSDBService struct {
+		config     OpenTSDBConfig
+		stats      *selfStats
+		keyFunc    BucketKeyFunc
+		conn       *reconnectingConn
+		sender     httpSender
+		counts     aggregator
+		mutex      sync.Mutex
+		pending    []openTSDBDatapoint
+		flushMutex sync.Mutex
+		closeOnce  sync.Once
+		stop       chan struct{}
+		done       chan struct{}
+	}
+
+	openTSDBDatapoint struct {
+		// key is the bucket key, in the format "metric tag=value tag2=value2".
+		key       string
+		value     float64
+		timestamp int64
+	}
+
+	openTSDBJSONDatapoint struct {
+		Metric    string            `json:"metric"`
+		Timestamp int64             `json:"timestamp"`
+		Value     float64           `json:"value"`
+		Tags      map[string]string `json:"tags"`
+	}
+)
+
+// NewOpenTSDBService returns a Service that writes to OpenTSDB, using either the telnet-style API, as lines like
+// "put metric timestamp value tag=value", over TCP, reconnecting and retrying as necessary, or the HTTP API, posting
+// batches of JSON datapoints, retrying with backoff, with timestamps in milliseconds. Gauges, histograms, and timings
+// (in milliseconds) each become a datapoint, while counts are summed per interval, and uniques are counted per
+// interval.
+//
+// OpenTSDB requires at least one tag per datapoint, and buckets without any tags, after applying DefaultTags, will
+// be dropped, as will buckets with multiple values for a tag, which OpenTSDB doesn't support. Note that datapoints that fail to send via the telnet-style API will be retried by the next flush,
+// while datapoints that fail to send via the HTTP API, after retries, will be dropped, as a request may fail due to
+// invalid datapoints.
+// http://opentsdb.net/docs/build/html/user_guide/writing/index.html
+func NewOpenTSDBService(config OpenTSDBConfig) Service {
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = time.Second * 10
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 50
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+	if config.KeyFunc == nil {
+		config.KeyFunc = NewOpenTSDBBucketKeyFunc()
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second * 10
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 10000
+	}
+
+	s := &openTSDBService{
+		config: config,
+		stats:  newSelfStats(config.Stats),
+		conn: &reconnectingConn{
+			network:      config.Network,
+			address:      config.Address,
+			dial:         config.Dial,
+			writeTimeout: config.WriteTimeout,
+		},
+		sender: httpSender{
+			client:     config.Client,
+			maxRetries: config.MaxRetries,
+			backoff:    config.RetryBackoff,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	s.keyFunc = func(info BucketInfo) (string, bool) {
+		if len(config.DefaultTags) != 0 {
+			info = info.clone()
+			if info.Tags == nil {
+				info.Tags = make(map[string][]string, len(config.DefaultTags))
+			}
+			for k, v := range config.DefaultTags {
+				if _, ok := info.Tags[k]; !ok {
+					info.Tags[k] = []string{v}
+				}
+			}
+		}
+		key, ok := config.KeyFunc(info)
+		if !ok || !strings.Contains(key, " ") {
+			return "", false
+		}
+		// repeated tag keys, e.g. using TagValuesAll, are rejected by the telnet-style API, and can't be represented
+		// by the HTTP API
+		fields := strings.Fields(key)[1:]
+		tags := make(map[string]struct{}, len(fields))
+		for _, field := range fields {
+			tag := field
+			if i := strings.IndexByte(field, '='); i >= 0 {
+				tag = field[:i]
+			}
+			if _, ok := tags[tag]; ok {
+				return "", false
+			}
+			tags[tag] = struct{}{}
+		}
+		return key, true
+	}
+
+	if config.Interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+// NewOpenTSDBBucketKeyFunc returns a key func that generates keys like "metric tag=value tag2=value2", sanitised
+// using OpenTSDBKeySanitisers, which is the format used by the telnet-style API, see NewOpenTSDBService.
+func NewOpenTSDBBucketKeyFunc(opts ...BucketKeyOption) BucketKeyFunc {
+	return newBucketKeyFunc(openTSDBBucketKeyFormat, OpenTSDBKeySanitisers(), opts...)
+}
+
+// OpenTSDBKeySanitisers returns the sanitisers used by NewOpenTSDBBucketKeyFunc, which apply SanitiseOpenTSDB to
+// every part of the key.
+func OpenTSDBKeySanitisers() KeySanitisers {
+	return KeySanitisers{
+		Bucket:   SanitiseOpenTSDB,
+		TagKey:   SanitiseOpenTSDB,
+		TagValue: SanitiseOpenTSDB,
+	}
+}
+
+// SanitiseOpenTSDB sanitises a metric name, tag key, or tag value, allowing letters, numbers, and any of `-_./`,
+// and replacing any other runes with a single '_'.
+func SanitiseOpenTSDB(value string) string {
+	return openTSDBSanitiser(value)
+}
+
+// Bucket returns a new bucket, using the configured KeyFunc, and DefaultTags.
+func (s *openTSDBService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, s.keyFunc, s.sample)
+}
+
+// BucketAt returns a new bucket, like Bucket, except that gauges, histograms, and timings will be timestamped with
+// the given time, rather than the current time, see TimestampService.
+func (s *openTSDBService) BucketAt(bucket interface{}, timestamp time.Time) Bucket {
+	return NewBucket(bucket, s.keyFunc, func(sample Sample) {
+		s.sampleAt(sample, timestamp)
+	})
+}
+
+// Flush writes all pending datapoints, including the current interval's counts.
+func (s *openTSDBService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.queue(s.queued)
+	defer s.stats.flushed(timeNow())
+
+	timestamp := timeNow().UnixNano() / int64(time.Millisecond)
+
+	for _, series := range s.counts.flush() {
+		s.add(openTSDBDatapoint{
+			key:       series.Key,
+			value:     series.Value(),
+			timestamp: timestamp,
+		})
+	}
+
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if s.config.URL != "" {
+		return s.post(pending)
+	}
+
+	b := encodeOpenTSDBTelnet(pending)
+
+	if err := s.conn.write(b); err != nil {
+		s.stats.error()
+		s.retry(pending)
+		return fmt.Errorf("appstats.openTSDBService.Flush write error: %s", err.Error())
+	}
+
+	s.stats.sent(len(pending), len(b))
+
+	return nil
+}
+
+// Close stops flushing in the background, then flushes, and closes the connection.
+func (s *openTSDBService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	err := s.Flush()
+	if closeErr := s.conn.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("appstats.openTSDBService.Close close error: %s", closeErr.Error())
+	}
+	return err
+}
+
+func (s *openTSDBService) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil && s.config.ErrorHandler != nil {
+				s.config.ErrorHandler(err)
+			}
+		}
+	}
+}
+
+func (s *openTSDBService) sample(sample Sample) {
+	s.sampleAt(sample, timeNow())
+}
+
+func (s *openTSDBService) sampleAt(sample Sample, timestamp time.Time) {
+	switch sample.Type {
+	case MetricCount, MetricUnique:
+		s.counts.add(sample)
+	default:
+		if value, ok := sample.Float64(); ok {
+			s.add(openTSDBDatapoint{
+				key:       sample.Key,
+				value:     value,
+				timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+			})
+		}
+	}
+}
+
+func (s *openTSDBService) add(datapoint openTSDBDatapoint) {
+	s.mutex.Lock()
+	var dropped int
+	if len(s.pending) >= s.config.MaxPending {
+		s.pending = s.pending[1:]
+		dropped++
+	}
+	s.pending = append(s.pending, datapoint)
+	s.mutex.Unlock()
+
+	s.stats.dropped(dropped)
+}
+
+// retry re-queues datapoints that failed to send, before any that were added in the meantime, dropping the oldest
+// to respect MaxPending.
+func (s *openTSDBService) retry(datapoints []openTSDBDatapoint) {
+	s.mutex.Lock()
+	var dropped int
+	datapoints = append(datapoints, s.pending...)
+	if len(datapoints) > s.config.MaxPending {
+		dropped = len(datapoints) - s.config.MaxPending
+		datapoints = datapoints[dropped:]
+	}
+	s.pending = datapoints
+	s.mutex.Unlock()
+
+	s.stats.dropped(dropped)
+}
+
+// discard drops all pending datapoints, rather than retrying them, see NewSpoolService.
+func (s *openTSDBService) discard() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = nil
+}
+
+// queued returns the number of pending datapoints.
+func (s *openTSDBService) queued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.pending)
+}
+
+// post sends datapoints to the HTTP API, in batches, returning the first error.
+func (s *openTSDBService) post(datapoints []openTSDBDatapoint) error {
+	header := make(http.Header, len(s.config.Header)+1)
+	for k, v := range s.config.Header {
+		header[k] = v
+	}
+	header.Set("Content-Type", "application/json")
+
+	var err error
+	for len(datapoints) > 0 {
+		n := s.config.BatchSize
+		if n > len(datapoints) {
+			n = len(datapoints)
+		}
+
+		batch := make([]openTSDBJSONDatapoint, n)
+		for i, datapoint := range datapoints[:n] {
+			batch[i] = datapoint.json()
+		}
+		datapoints = datapoints[n:]
+
+		body, _ := json.Marshal(batch)
+
+		if sendErr := s.sender.send(http.MethodPost, s.config.URL, header, body); sendErr != nil {
+			s.stats.error()
+			s.stats.dropped(n)
+			if err == nil {
+				err = fmt.Errorf("appstats.openTSDBService.Flush send error: %s", sendErr.Error())
+			}
+		} else {
+			s.stats.sent(n, len(body))
+		}
+	}
+
+	return err
+}
+
+// json converts the datapoint to the HTTP API format, by parsing the key.
+func (d openTSDBDatapoint) json() openTSDBJSONDatapoint {
+	fields := strings.Fields(d.key)
+	r := openTSDBJSONDatapoint{
+		Timestamp: d.timestamp,
+		Value:     d.value,
+		Tags:      make(map[string]string, len(fields)),
+	}
+	if len(fields) != 0 {
+		r.Metric = fields[0]
+		for _, field := range fields[1:] {
+			if i := strings.IndexByte(field, '='); i >= 0 {
+				r.Tags[field[:i]] = field[i+1:]
+			}
+		}
+	}
+	return r
+}
+
+func encodeOpenTSDBTelnet(datapoints []openTSDBDatapoint) []byte {
+	var b bytes.Buffer
+	for _, datapoint := range datapoints {
+		metric, tags := datapoint.key, ""
+		if i := strings.IndexByte(metric, ' '); i >= 0 {
+			metric, tags = metric[:i], metric[i:]
+		}
+		b.WriteString("put ")
+		b.WriteString(metric)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(datapoint.timestamp, 10))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(datapoint.value, 'f', -1, 64))
+		b.WriteString(tags)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,307 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestNewOpenTSDBBucketKeyFunc(t *testing.T) {
+	testCases := []struct {
+		Info BucketInfo
+		Key  string
+		Ok   bool
+	}{
+		{
+			Info: BucketInfo{},
+		},
+		{
+			Info: BucketInfo{Bucket: "sys.cpu.user"},
+			Key:  "sys.cpu.user",
+			Ok:   true,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: "http requests",
+				Tags: map[string][]string{
+					"status": {"200"},
+					"host":   {"web 01", "web=02"},
+					"empty":  {""},
+				},
+			},
+			Key: "http_requests host=web_02 status=200",
+			Ok:  true,
+		},
+	}
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewOpenTSDBBucketKeyFunc_#%d", i+1)
+
+		key, ok := NewOpenTSDBBucketKeyFunc()(testCase.Info)
+
+		if key != testCase.Key || ok != testCase.Ok {
+			t.Error(name, "expected =", testCase.Key, testCase.Ok, "actual =", key, ok)
+		}
+	}
+}
+
+func TestSanitiseOpenTSDB(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output string
+	}{
+		{"", ""},
+		{"sys.cpu/user-1_a", "sys.cpu/user-1_a"},
+		{"üñí", "üñí"},
+		{"a  b::c", "a_b_c"},
+	}
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSanitiseOpenTSDB_#%d", i+1)
+		if output := SanitiseOpenTSDB(testCase.Input); output != testCase.Output {
+			t.Error(name, "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestOpenTSDBService_telnet(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 5e6))()
+
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	s := NewOpenTSDBService(OpenTSDBConfig{
+		Address:     listener.Addr().String(),
+		DefaultTags: map[string]string{"host": "web01"},
+		Interval:    -1,
+	})
+
+	bucket := s.Bucket("http.requests").Tag("status", "200")
+	bucket.Count(2)
+	bucket.Increment()
+	bucket.Gauge(1.5)
+	bucket.Timing(time.Millisecond * 250)
+	s.Bucket("other").Tag("host", "web02").Unique("a")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.expect(
+		t,
+		"put http.requests 1500000000005 1.5 host=web01 status=200",
+		"put http.requests 1500000000005 250 host=web01 status=200",
+		"put http.requests 1500000000005 3 host=web01 status=200",
+		"put other 1500000000005 1 host=web02",
+	)
+}
+
+func TestOpenTSDBService_noTags(t *testing.T) {
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	s := NewOpenTSDBService(OpenTSDBConfig{
+		Address:  listener.Addr().String(),
+		Interval: -1,
+	})
+
+	s.Bucket("dropped").Increment()
+	s.Bucket("dropped").Tag("empty", "").Gauge(1)
+	s.Bucket("kept").Tag("a", "b").Gauge(1)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-listener.lines:
+		if line[:len("put kept ")] != "put kept " {
+			t.Error("unexpected line", line)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+}
+
+func TestOpenTSDBService_repeatedTags(t *testing.T) {
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	s := NewOpenTSDBService(OpenTSDBConfig{
+		Address:  listener.Addr().String(),
+		KeyFunc:  NewOpenTSDBBucketKeyFunc(BucketKeyTagValues(TagValuesAll)),
+		Interval: -1,
+	})
+
+	s.Bucket("dropped").Tag("a", "b", "c").Gauge(1)
+	s.Bucket("kept").Tag("a", "b").Gauge(1)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-listener.lines:
+		if line[:len("put kept ")] != "put kept " {
+			t.Error("unexpected line", line)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+}
+
+func TestOpenTSDBService_telnetRetry(t *testing.T) {
+	defer stubTimeNow(time.Unix(1, 0))()
+
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	var fail = true
+	s := NewOpenTSDBService(OpenTSDBConfig{
+		Address: listener.Addr().String(),
+		Dial: func(network, address string) (net.Conn, error) {
+			if fail {
+				return nil, fmt.Errorf("some error")
+			}
+			return net.Dial(network, address)
+		},
+		Interval: -1,
+	})
+
+	s.Bucket("a").Tag("k", "v").Gauge(1)
+
+	if err := s.Flush(); err == nil || err.Error() != "appstats.openTSDBService.Flush write error: some error" {
+		t.Fatal("unexpected err", err)
+	}
+
+	fail = false
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.expect(t, "put a 1000 1 k=v")
+
+	// discarded, rather than retried, as used by NewSpoolService
+	fail = true
+	s.(*openTSDBService).conn.close()
+	s.Bucket("b").Tag("k", "v").Gauge(2)
+
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	s.(*openTSDBService).discard()
+
+	fail = false
+	s.Bucket("c").Tag("k", "v").Gauge(3)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.expect(t, "put c 1000 3 k=v")
+}
+
+func TestOpenTSDBService_http(t *testing.T) {
+	defer stubTimeNow(time.Unix(1500000000, 0))()
+
+	var (
+		mutex   sync.Mutex
+		batches [][]openTSDBJSONDatapoint
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/put" || r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected request", r.URL, r.Header)
+		}
+		var batch []openTSDBJSONDatapoint
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		batches = append(batches, batch)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s := NewOpenTSDBService(OpenTSDBConfig{
+		URL:         server.URL + "/api/put",
+		Client:      server.Client(),
+		BatchSize:   2,
+		DefaultTags: map[string]string{"host": "web01"},
+		Interval:    -1,
+	})
+
+	s.Bucket("a").Gauge(1)
+	s.Bucket("b").Tag("k", "v").Histogram(2)
+	s.Bucket("c").Increment()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if diff := deep.Equal(
+		batches,
+		[][]openTSDBJSONDatapoint{
+			{
+				{Metric: "a", Timestamp: 1500000000000, Value: 1, Tags: map[string]string{"host": "web01"}},
+				{Metric: "b", Timestamp: 1500000000000, Value: 2, Tags: map[string]string{"host": "web01", "k": "v"}},
+			},
+			{
+				{Metric: "c", Timestamp: 1500000000000, Value: 1, Tags: map[string]string{"host": "web01"}},
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOpenTSDBService_httpError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	s := NewOpenTSDBService(OpenTSDBConfig{
+		URL:      server.URL,
+		Client:   server.Client(),
+		Interval: -1,
+	})
+
+	s.Bucket("a").Tag("k", "v").Gauge(1)
+
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// failed requests are not retried by the next flush
+	if err := s.Flush(); err != nil {
+		t.Error(err)
+	}
+}
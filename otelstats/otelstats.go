@@ -0,0 +1,299 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package otelstats provides an appstats.Service implemented on top of an OpenTelemetry metric.MeterProvider, and
+// is a separate package to avoid the dependency for other users of appstats.
+package otelstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/joeycumines/go-appstats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// DefaultMeterName is the name of the meter used if Config.MeterName is not set.
+const DefaultMeterName = "github.com/joeycumines/go-appstats/otelstats"
+
+type (
+	// Config configures a Service created by NewService, note that all fields are optional.
+	Config struct {
+		// MeterProvider defaults to otel.GetMeterProvider().
+		MeterProvider metric.MeterProvider
+		// MeterName defaults to DefaultMeterName.
+		MeterName string
+		// NameFunc generates instrument names from bucket names, and defaults to SanitiseInstrumentName, note that
+		// metrics for which it returns an empty name will be dropped.
+		NameFunc func(bucket string) string
+		// Metadata is an optional registry, which provides the unit (except for timings) and description of each
+		// instrument, from the metadata registered with the bucket name.
+		Metadata *appstats.MetadataRegistry
+		// ErrorHandler will be called with any errors creating instruments, and defaults to otel.Handle.
+		ErrorHandler func(err error)
+	}
+
+	service struct {
+		config      Config
+		meter       metric.Meter
+		mutex       sync.Mutex
+		instruments map[instrumentKey]interface{}
+		// kinds is the kind of the instrument created for each name, as each name may only be used for one kind.
+		kinds map[string]instrumentKind
+		// cache is keyed by bucket name, rather than BucketInfo, so that it is not unbounded for tags with high
+		// cardinality, e.g. request IDs.
+		cache sync.Map
+	}
+
+	instrumentKey struct {
+		name string
+		kind instrumentKind
+	}
+
+	instrumentKind int
+
+	// series caches the instrument name and metadata for a bucket name.
+	series struct {
+		name        string
+		unit        string
+		description string
+	}
+)
+
+const (
+	kindCounter instrumentKind = iota
+	kindGauge
+	kindUpDownCounter
+	kindHistogram
+	kindTiming
+)
+
+var instrumentNameSanitiser = appstats.NewSanitiser(
+	appstats.SanitiserMaxLength(255),
+	appstats.SanitiserLeading(isASCIILetter),
+	appstats.SanitiserAllowed(appstats.AnyRuneClass(
+		isASCIILetter,
+		func(r rune) bool { return r >= '0' && r <= '9' },
+		appstats.RuneClassOf("_.-/"),
+	)),
+	appstats.SanitiserReplacement('_'),
+)
+
+// NewService returns an appstats.Service that records metrics using instruments created lazily (once per name and
+// kind) from a meter, with each bucket's tags as attributes, using a string attribute for tags with a single value,
+// and a string slice attribute for tags with multiple values, tags with no values are omitted.
+//
+// Counts are recorded using a Float64Counter, gauges using a Float64Gauge, or, for strings with an explicit sign
+// like "+5" or "-3", which are deltas per the StatsD protocol, a Float64UpDownCounter, histograms using a
+// Float64Histogram, and timings using a Float64Histogram with the unit "ms". OpenTelemetry has no equivalent for
+// uniques, so they are recorded as a count of occurrences.
+//
+// Each instrument name may only be used for a single kind of instrument, as OpenTelemetry treats instruments with the
+// same name but a different kind (or unit) as conflicting, meaning that e.g. a gauge must either always or never be
+// set using a sign, and any metrics of a different kind to the first recorded for a name will be dropped, with an
+// error passed to the ErrorHandler, once per kind.
+//
+// Note that since the meter provider is not owned by the service, Close does nothing, and Flush calls the
+// ForceFlush method of the provider, if it has one, e.g. the SDK's MeterProvider.
+func NewService(config Config) appstats.Service {
+	if config.MeterProvider == nil {
+		config.MeterProvider = otel.GetMeterProvider()
+	}
+	if config.MeterName == "" {
+		config.MeterName = DefaultMeterName
+	}
+	if config.NameFunc == nil {
+		config.NameFunc = SanitiseInstrumentName
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = otel.Handle
+	}
+	return &service{
+		config:      config,
+		meter:       config.MeterProvider.Meter(config.MeterName),
+		instruments: make(map[instrumentKey]interface{}),
+		kinds:       make(map[string]instrumentKind),
+	}
+}
+
+// SanitiseInstrumentName sanitises a bucket name to match the OpenTelemetry instrument name syntax,
+// `[A-Za-z][A-Za-z0-9_.\-/]{0,254}`, dropping any leading runes that are not ASCII letters, and replacing any other
+// invalid runes with '_'.
+func SanitiseInstrumentName(bucket string) string {
+	return instrumentNameSanitiser(bucket)
+}
+
+func (s *service) Bucket(bucket interface{}) appstats.Bucket {
+	return appstats.NewBucket(bucket, identityKey, s.record)
+}
+
+func (s *service) Flush() error {
+	if flusher, ok := s.config.MeterProvider.(interface {
+		ForceFlush(ctx context.Context) error
+	}); ok {
+		return flusher.ForceFlush(context.Background())
+	}
+	return nil
+}
+
+func (s *service) Close() error {
+	return nil
+}
+
+func (s *service) record(sample appstats.Sample) {
+	series := s.series(sample)
+	if series.name == "" {
+		return
+	}
+
+	ctx := context.Background()
+	attributes := metric.WithAttributeSet(Attributes(sample.Info))
+
+	switch sample.Type {
+	case appstats.MetricCount:
+		if value, ok := sample.Float64(); ok {
+			if counter, ok := s.instrument(series, kindCounter).(metric.Float64Counter); ok {
+				counter.Add(ctx, value, attributes)
+			}
+		}
+
+	case appstats.MetricUnique:
+		if counter, ok := s.instrument(series, kindCounter).(metric.Float64Counter); ok {
+			counter.Add(ctx, 1, attributes)
+		}
+
+	case appstats.MetricGauge:
+		value, ok := sample.Float64()
+		if !ok {
+			return
+		}
+		if str, _ := sample.Value.(string); strings.HasPrefix(str, "+") || strings.HasPrefix(str, "-") {
+			if counter, ok := s.instrument(series, kindUpDownCounter).(metric.Float64UpDownCounter); ok {
+				counter.Add(ctx, value, attributes)
+			}
+			return
+		}
+		if gauge, ok := s.instrument(series, kindGauge).(metric.Float64Gauge); ok {
+			gauge.Record(ctx, value, attributes)
+		}
+
+	case appstats.MetricHistogram, appstats.MetricTiming:
+		kind := kindHistogram
+		if sample.Type == appstats.MetricTiming {
+			kind = kindTiming
+		}
+		if value, ok := sample.Float64(); ok {
+			if histogram, ok := s.instrument(series, kind).(metric.Float64Histogram); ok {
+				histogram.Record(ctx, value, attributes)
+			}
+		}
+	}
+}
+
+// series returns the cached instrument name and metadata for a sample's bucket name.
+func (s *service) series(sample appstats.Sample) *series {
+	if v, ok := s.cache.Load(sample.Info.Bucket); ok {
+		return v.(*series)
+	}
+	metadata, _ := s.config.Metadata.Lookup(sample.Info.Bucket)
+	v, _ := s.cache.LoadOrStore(sample.Info.Bucket, &series{
+		name:        s.config.NameFunc(sample.Info.Bucket),
+		unit:        metadata.Unit,
+		description: metadata.Description,
+	})
+	return v.(*series)
+}
+
+// instrument returns the instrument for the series name and kind, creating it if necessary, or nil if that failed,
+// or if the name was already used for a different kind, note that the unit and description are those of the series
+// that created it.
+func (s *service) instrument(series *series, kind instrumentKind) interface{} {
+	name := series.name
+	key := instrumentKey{name: name, kind: kind}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if instrument, ok := s.instruments[key]; ok {
+		return instrument
+	}
+
+	if existing, ok := s.kinds[name]; ok && existing != kind {
+		s.config.ErrorHandler(fmt.Errorf("otelstats.service.instrument %s conflicts with an instrument of another kind", name))
+		s.instruments[key] = nil
+		return nil
+	}
+	s.kinds[name] = kind
+
+	var (
+		instrument interface{}
+		err        error
+	)
+	unit, description := metric.WithUnit(series.unit), metric.WithDescription(series.description)
+	switch kind {
+	case kindCounter:
+		instrument, err = s.meter.Float64Counter(name, unit, description)
+	case kindGauge:
+		instrument, err = s.meter.Float64Gauge(name, unit, description)
+	case kindUpDownCounter:
+		instrument, err = s.meter.Float64UpDownCounter(name, unit, description)
+	case kindHistogram:
+		instrument, err = s.meter.Float64Histogram(name, unit, description)
+	case kindTiming:
+		instrument, err = s.meter.Float64Histogram(name, metric.WithUnit("ms"), description)
+	}
+	if err != nil {
+		s.config.ErrorHandler(fmt.Errorf("otelstats.service.instrument %s error: %s", name, err.Error()))
+	}
+
+	// the instrument is cached even if there was an error, as it will be a usable no-op, if it is not nil
+	s.instruments[key] = instrument
+
+	return instrument
+}
+
+// Attributes converts the tags of a BucketInfo to an attribute set, see NewService.
+func Attributes(info appstats.BucketInfo) attribute.Set {
+	attributes := make([]attribute.KeyValue, 0, len(info.Tags))
+	for key, values := range info.Tags {
+		switch len(values) {
+		case 0:
+		case 1:
+			attributes = append(attributes, attribute.String(key, values[0]))
+		default:
+			attributes = append(attributes, attribute.StringSlice(key, values))
+		}
+	}
+	return attribute.NewSet(attributes...)
+}
+
+// identityKey is the key func used by the service, which is unique per BucketInfo.
+func identityKey(info appstats.BucketInfo) (string, bool) {
+	b, err := info.MarshalText()
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func isASCIILetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
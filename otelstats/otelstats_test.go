@@ -0,0 +1,291 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package otelstats
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/joeycumines/go-appstats"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collect returns a summary of all data points collected by reader, keyed by instrument name then attributes.
+func collect(t *testing.T, reader sdkmetric.Reader) map[string]map[string]interface{} {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]map[string]interface{})
+	for _, sm := range rm.ScopeMetrics {
+		if sm.Scope.Name != DefaultMeterName {
+			t.Error("unexpected scope", sm.Scope.Name)
+		}
+		for _, m := range sm.Metrics {
+			points := make(map[string]interface{})
+			switch data := m.Data.(type) {
+			case metricdata.Sum[float64]:
+				for _, p := range data.DataPoints {
+					points[p.Attributes.Encoded(attribute.DefaultEncoder())] = fmt.Sprintf("sum monotonic=%v %v", data.IsMonotonic, p.Value)
+				}
+			case metricdata.Gauge[float64]:
+				for _, p := range data.DataPoints {
+					points[p.Attributes.Encoded(attribute.DefaultEncoder())] = fmt.Sprintf("gauge %v", p.Value)
+				}
+			case metricdata.Histogram[float64]:
+				for _, p := range data.DataPoints {
+					points[p.Attributes.Encoded(attribute.DefaultEncoder())] = fmt.Sprintf("histogram %s count=%d sum=%v", m.Unit, p.Count, p.Sum)
+				}
+			default:
+				t.Errorf("unexpected data %T", data)
+			}
+			result[m.Name] = points
+		}
+	}
+	return result
+}
+
+func TestNewService(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	s := NewService(Config{MeterProvider: provider})
+
+	s.Bucket("requests").Tag("status", "200").Count(2)
+	s.Bucket("requests").Tag("status", "200").Increment()
+	s.Bucket("requests").Tag("status", "500").Increment()
+	s.Bucket("users").Unique("a")
+	s.Bucket("users").Unique("b")
+	s.Bucket("queue.depth").Gauge(10)
+	s.Bucket("queue.depth").Gauge(7)
+	s.Bucket("connections").Gauge("+5")
+	s.Bucket("connections").Gauge("-2")
+	s.Bucket("size").Tag("region", "a", "b").Histogram(3)
+	s.Bucket("size").Tag("region", "a", "b").Histogram(4.5)
+	s.Bucket("latency").Timing(time.Millisecond * 250)
+	s.Bucket("1 invalid").Increment()
+	s.Bucket("!!!").Increment()
+	s.Bucket("bad_value").Gauge("abc")
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		collect(t, reader),
+		map[string]map[string]interface{}{
+			"requests": {
+				"status=200": "sum monotonic=true 3",
+				"status=500": "sum monotonic=true 1",
+			},
+			"users": {
+				"": "sum monotonic=true 2",
+			},
+			"queue.depth": {
+				"": "gauge 7",
+			},
+			"connections": {
+				"": "sum monotonic=false 3",
+			},
+			"size": {
+				`region=["a","b"]`: "histogram  count=2 sum=7.5",
+			},
+			"latency": {
+				"": "histogram ms count=1 sum=250",
+			},
+			"invalid": {
+				"": "sum monotonic=true 1",
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewService_metadata(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	s := NewService(Config{
+		MeterProvider: provider,
+		Metadata: appstats.NewMetadataRegistry(
+			appstats.MetricMetadata{Name: "size", Unit: "By", Description: "The size of each request."},
+			appstats.MetricMetadata{Name: "latency", Unit: "s", Description: "The latency of each request."},
+		),
+	})
+
+	s.Bucket("size").Histogram(3)
+	s.Bucket("latency").Timing(time.Millisecond * 250)
+	s.Bucket("requests").Increment()
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]string)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m.Unit + " " + m.Description
+		}
+	}
+	if diff := deep.Equal(
+		metrics,
+		map[string]string{
+			"size":     "By The size of each request.",
+			"latency":  "ms The latency of each request.",
+			"requests": " ",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestNewService_cache(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	s := NewService(Config{MeterProvider: provider})
+
+	for i := 0; i < 100; i++ {
+		s.Bucket("requests").Tag("request_id", i).Increment()
+	}
+
+	// the cache is keyed by bucket name, rather than growing per tag value
+	var entries int
+	s.(*service).cache.Range(func(key, value interface{}) bool {
+		entries++
+		return true
+	})
+	if entries != 1 {
+		t.Error(entries)
+	}
+
+	if n := len(collect(t, reader)["requests"]); n != 100 {
+		t.Error(n)
+	}
+}
+
+func TestNewService_errorHandler(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	var errs []error
+	s := NewService(Config{
+		MeterProvider: provider,
+		NameFunc: func(bucket string) string {
+			return bucket
+		},
+		ErrorHandler: func(err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	s.Bucket("in valid").Increment()
+	s.Bucket("in valid").Increment()
+
+	if len(errs) != 1 {
+		t.Fatal("unexpected errs", errs)
+	}
+}
+
+func TestNewService_conflictingKinds(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	var errs []string
+	s := NewService(Config{
+		MeterProvider: provider,
+		ErrorHandler: func(err error) {
+			errs = append(errs, err.Error())
+		},
+	})
+
+	s.Bucket("connections").Gauge("+5")
+	s.Bucket("connections").Gauge(3)
+	s.Bucket("connections").Gauge(4)
+	s.Bucket("connections").Gauge("-2")
+	s.Bucket("size").Histogram(3)
+	s.Bucket("size").Timing(time.Second)
+
+	if diff := deep.Equal(
+		collect(t, reader),
+		map[string]map[string]interface{}{
+			"connections": {"": "sum monotonic=false 3"},
+			"size":        {"": "histogram  count=1 sum=3"},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		errs,
+		[]string{
+			"otelstats.service.instrument connections conflicts with an instrument of another kind",
+			"otelstats.service.instrument size conflicts with an instrument of another kind",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSanitiseInstrumentName(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output string
+	}{
+		{"", ""},
+		{"http.server.duration", "http.server.duration"},
+		{"_1a b/c-d", "a_b/c-d"},
+		{"a:b", "a_b"},
+	}
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSanitiseInstrumentName_#%d", i+1)
+		if output := SanitiseInstrumentName(testCase.Input); output != testCase.Output {
+			t.Error(name, "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	set := Attributes(appstats.BucketInfo{
+		Bucket: "bucket",
+		Tags: map[string][]string{
+			"a": {"1"},
+			"b": {"2", "3"},
+			"c": nil,
+		},
+	})
+	if diff := deep.Equal(set.Encoded(attribute.DefaultEncoder()), `a=1,b=["2","3"]`); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,782 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// OTLPTemporalityDelta reports the change since the last export, and is the default.
+	OTLPTemporalityDelta OTLPTemporality = 1
+	// OTLPTemporalityCumulative reports the total since the start of the service.
+	OTLPTemporalityCumulative OTLPTemporality = 2
+)
+
+// DefaultOTLPHistogramBounds are the default explicit bucket boundaries for histograms, which are the same as the
+// OpenTelemetry SDK's defaults.
+var DefaultOTLPHistogramBounds = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+type (
+	// OTLPTemporality is the aggregation temporality of sums and histograms, and uses the same values as the OTLP
+	// AggregationTemporality enum.
+	OTLPTemporality int
+
+	// OTLPConfig configures a Service created by NewOTLPService, note that all fields are optional.
+	OTLPConfig struct {
+		// Endpoint is the URL to post metrics to, it defaults to "http://localhost:4318/v1/metrics".
+		Endpoint string
+		// Client defaults to http.DefaultClient.
+		Client *http.Client
+		// Header will be added to each request, e.g. for authentication.
+		Header http.Header
+		// JSON enables the JSON encoding, instead of the (default) protobuf encoding.
+		JSON bool
+		// Temporality defaults to OTLPTemporalityDelta.
+		Temporality OTLPTemporality
+		// NameFunc generates metric names from bucket names, and defaults to using the bucket name as-is, note that
+		// metrics for which it returns an empty name will be dropped.
+		NameFunc func(bucket string) string
+		// HistogramBounds defaults to DefaultOTLPHistogramBounds, and must be sorted in increasing order.
+		HistogramBounds []float64
+		// Resource is the attributes of the resource the metrics are associated with, e.g. "service.name".
+		Resource map[string]string
+		// ScopeName is the name of the instrumentation scope, it defaults to "github.com/joeycumines/go-appstats".
+		ScopeName string
+		// Interval is the aggregation interval, and how frequently metrics will be exported, it defaults to 10
+		// seconds, and a negative value disables exporting in the background.
+		Interval time.Duration
+		// MaxBatchSize is the max number of data points per request, it defaults to 1000.
+		MaxBatchSize int
+		// MaxRetries is the max number of times a failed request will be retried, it defaults to 3, and a negative
+		// value disables retries.
+		MaxRetries int
+		// RetryBackoff is the delay before the first retry, which doubles for each retry, it defaults to 1 second.
+		RetryBackoff time.Duration
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines counts data points, and StatDrops counts data points that failed to export.
+		Stats Bucket
+		// Metadata is an optional registry, which provides the unit (except for timings) and description of each
+		// metric, from the metadata registered with the bucket name.
+		Metadata *MetadataRegistry
+		// ErrorHandler will be called with any errors exporting in the background, if it is set.
+		ErrorHandler func(err error)
+	}
+
+	otlpService struct {
+		config     OTLPConfig
+		sender     httpSender
+		stats      *selfStats
+		aggregator aggregator
+		flushMutex sync.Mutex
+		// start is the start time of the current (delta) interval.
+		start time.Time
+		// cumulative is the state of every sum and histogram, if the temporality is cumulative.
+		cumulative map[aggregateKey]*otlpPoint
+		closeOnce  sync.Once
+		stop       chan struct{}
+		done       chan struct{}
+	}
+
+	// otlpPoint is an aggregated data point, prior to conversion to the OTLP data model.
+	otlpPoint struct {
+		name         string
+		unit         string
+		description  string
+		kind         otlpKind
+		tags         map[string][]string
+		start        time.Time
+		value        float64
+		count        uint64
+		sum          float64
+		min          float64
+		max          float64
+		bucketCounts []uint64
+		// decreasing indicates that a sum included a negative delta, and therefore isn't monotonic.
+		decreasing bool
+	}
+
+	otlpKind int
+
+	// the following types model the subset of the OTLP ExportMetricsServiceRequest message that is used, with the
+	// field names and JSON encoding that are specified by OTLP/JSON.
+	// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+	otlpExportRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Unit        string         `json:"unit,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	}
+
+	otlpGauge struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	}
+
+	otlpSum struct {
+		DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+		AggregationTemporality OTLPTemporality       `json:"aggregationTemporality"`
+		IsMonotonic            bool                  `json:"isMonotonic"`
+	}
+
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+		AggregationTemporality OTLPTemporality          `json:"aggregationTemporality"`
+	}
+
+	otlpNumberDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+		TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+		AsDouble          float64        `json:"asDouble"`
+	}
+
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+		TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+		Count             otlpUint64     `json:"count"`
+		Sum               float64        `json:"sum"`
+		BucketCounts      []otlpUint64   `json:"bucketCounts"`
+		ExplicitBounds    []float64      `json:"explicitBounds"`
+		Min               float64        `json:"min"`
+		Max               float64        `json:"max"`
+	}
+
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+
+	otlpAnyValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	}
+
+	otlpArrayValue struct {
+		Values []otlpAnyValue `json:"values"`
+	}
+
+	// otlpUint64 is encoded as a JSON string, as OTLP/JSON requires for 64 bit integers.
+	otlpUint64 uint64
+
+	// protoBuffer is a minimal protobuf encoder, supporting the wire types used by OTLP.
+	protoBuffer struct {
+		b []byte
+	}
+)
+
+const (
+	otlpKindSum otlpKind = iota
+	otlpKindGauge
+	otlpKindHistogram
+)
+
+// NewOTLPService returns a Service that aggregates metrics per interval, and exports them using OTLP over HTTP,
+// encoded as protobuf or JSON, without depending on the OpenTelemetry SDK. Each bucket's tags become attributes,
+// using a string value for tags with a single value, and an array value for tags with multiple values.
+//
+// Counts are exported as sums, which are monotonic unless any count was negative (for the life of the series, with
+// cumulative temporality), gauges as gauges (of the last value), uniques as gauges of the number of distinct values
+// per interval, histograms as explicit bucket histograms, and timings as histograms with the unit "ms". With cumulative temporality, every sum and histogram is exported on each flush, meaning that a failed
+// export loses no data, while with delta temporality, data that could not be exported (after retries) is dropped.
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+func NewOTLPService(config OTLPConfig) Service {
+	if config.Endpoint == "" {
+		config.Endpoint = "http://localhost:4318/v1/metrics"
+	}
+	if config.Temporality == 0 {
+		config.Temporality = OTLPTemporalityDelta
+	}
+	if config.HistogramBounds == nil {
+		config.HistogramBounds = DefaultOTLPHistogramBounds
+	}
+	if config.ScopeName == "" {
+		config.ScopeName = "github.com/joeycumines/go-appstats"
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second * 10
+	}
+	if config.MaxBatchSize <= 0 {
+		config.MaxBatchSize = 1000
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	s := &otlpService{
+		config: config,
+		sender: httpSender{
+			client:     config.Client,
+			maxRetries: config.MaxRetries,
+			backoff:    config.RetryBackoff,
+		},
+		stats:      newSelfStats(config.Stats),
+		aggregator: aggregator{values: true},
+		start:      timeNow(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if config.Temporality == OTLPTemporalityCumulative {
+		s.cumulative = make(map[aggregateKey]*otlpPoint)
+	}
+
+	if config.Interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+// Bucket returns a new bucket, keyed by the canonical text encoding of its BucketInfo.
+func (s *otlpService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, s.sample)
+}
+
+// Flush exports all metrics aggregated since the last flush, in batches, returning the first error.
+func (s *otlpService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.flushed(timeNow())
+
+	now := timeNow()
+	points := s.points(s.aggregator.flush())
+	s.start = now
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	contentType := "application/x-protobuf"
+	if s.config.JSON {
+		contentType = "application/json"
+	}
+	header := make(http.Header, len(s.config.Header)+1)
+	for k, v := range s.config.Header {
+		header[k] = v
+	}
+	header.Set("Content-Type", contentType)
+
+	var err error
+	for len(points) > 0 {
+		n := s.config.MaxBatchSize
+		if n > len(points) {
+			n = len(points)
+		}
+
+		request := s.request(points[:n], now)
+		points = points[n:]
+
+		var body []byte
+		if s.config.JSON {
+			body, _ = json.Marshal(request)
+		} else {
+			body = request.marshalProto()
+		}
+
+		if sendErr := s.sender.send(http.MethodPost, s.config.Endpoint, header, body); sendErr != nil {
+			s.stats.error()
+			s.stats.dropped(n)
+			if err == nil {
+				err = fmt.Errorf("appstats.otlpService.Flush send error: %s", sendErr.Error())
+			}
+		} else {
+			s.stats.sent(n, len(body))
+		}
+	}
+
+	return err
+}
+
+// Close stops exporting in the background, then flushes.
+func (s *otlpService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.Flush()
+}
+
+func (s *otlpService) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil && s.config.ErrorHandler != nil {
+				s.config.ErrorHandler(err)
+			}
+		}
+	}
+}
+
+func (s *otlpService) sample(sample Sample) {
+	s.aggregator.add(sample)
+}
+
+// points converts aggregates to data points, merging them into the cumulative state, if enabled, in which case
+// all the cumulative sums and histograms are returned, sorted by key, following the gauges.
+func (s *otlpService) points(series []*aggregate) []*otlpPoint {
+	points := make([]*otlpPoint, 0, len(series))
+
+	for _, v := range series {
+		name := v.Info.Bucket
+		if s.config.NameFunc != nil {
+			name = s.config.NameFunc(name)
+		}
+		if name == "" {
+			continue
+		}
+
+		point := &otlpPoint{
+			name:  name,
+			tags:  v.Info.Tags,
+			start: s.start,
+		}
+
+		if metadata, ok := s.config.Metadata.Lookup(v.Info.Bucket); ok {
+			point.unit = metadata.Unit
+			point.description = metadata.Description
+		}
+
+		switch v.Type {
+		case MetricCount:
+			point.kind = otlpKindSum
+			point.value = v.Sum
+			point.decreasing = v.Min < 0
+		case MetricGauge, MetricUnique:
+			point.kind = otlpKindGauge
+			point.value = v.Value()
+		default:
+			point.kind = otlpKindHistogram
+			if v.Type == MetricTiming {
+				point.unit = "ms"
+			}
+			point.count = uint64(v.Count)
+			point.sum = v.Sum
+			point.min = v.Min
+			point.max = v.Max
+			point.bucketCounts = make([]uint64, len(s.config.HistogramBounds)+1)
+			for _, value := range v.Values {
+				point.bucketCounts[sort.SearchFloat64s(s.config.HistogramBounds, value)]++
+			}
+		}
+
+		if s.cumulative != nil && point.kind != otlpKindGauge {
+			k := aggregateKey{key: v.Key, metricType: v.Type}
+			if state, ok := s.cumulative[k]; ok {
+				state.merge(point)
+			} else {
+				s.cumulative[k] = point
+			}
+			continue
+		}
+
+		points = append(points, point)
+	}
+
+	if s.cumulative != nil {
+		keys := make([]aggregateKey, 0, len(s.cumulative))
+		for k := range s.cumulative {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].key != keys[j].key {
+				return keys[i].key < keys[j].key
+			}
+			return keys[i].metricType < keys[j].metricType
+		})
+		for _, k := range keys {
+			points = append(points, s.cumulative[k])
+		}
+	}
+
+	return points
+}
+
+// request builds an export request for points, grouping data points by metric name, kind and unit.
+func (s *otlpService) request(points []*otlpPoint, now time.Time) *otlpExportRequest {
+	type metricKey struct {
+		name string
+		unit string
+		kind otlpKind
+	}
+
+	var (
+		metrics []otlpMetric
+		index   = make(map[metricKey]int)
+		end     = otlpUint64(now.UnixNano())
+	)
+
+	for _, point := range points {
+		k := metricKey{name: point.name, unit: point.unit, kind: point.kind}
+		i, ok := index[k]
+		if !ok {
+			metric := otlpMetric{Name: point.name, Description: point.description, Unit: point.unit}
+			switch point.kind {
+			case otlpKindSum:
+				metric.Sum = &otlpSum{AggregationTemporality: s.config.Temporality, IsMonotonic: true}
+			case otlpKindGauge:
+				metric.Gauge = &otlpGauge{}
+			default:
+				metric.Histogram = &otlpHistogram{AggregationTemporality: s.config.Temporality}
+			}
+			i = len(metrics)
+			index[k] = i
+			metrics = append(metrics, metric)
+		}
+
+		start := otlpUint64(point.start.UnixNano())
+		attributes := otlpAttributes(point.tags)
+
+		switch metric := &metrics[i]; point.kind {
+		case otlpKindSum:
+			if point.decreasing {
+				metric.Sum.IsMonotonic = false
+			}
+			metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      end,
+				AsDouble:          point.value,
+			})
+		case otlpKindGauge:
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: end,
+				AsDouble:     point.value,
+			})
+		default:
+			bucketCounts := make([]otlpUint64, len(point.bucketCounts))
+			for j, v := range point.bucketCounts {
+				bucketCounts[j] = otlpUint64(v)
+			}
+			metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      end,
+				Count:             otlpUint64(point.count),
+				Sum:               point.sum,
+				BucketCounts:      bucketCounts,
+				ExplicitBounds:    s.config.HistogramBounds,
+				Min:               point.min,
+				Max:               point.max,
+			})
+		}
+	}
+
+	var resource otlpResource
+	if len(s.config.Resource) != 0 {
+		tags := make(map[string][]string, len(s.config.Resource))
+		for k, v := range s.config.Resource {
+			tags[k] = []string{v}
+		}
+		resource.Attributes = otlpAttributes(tags)
+	}
+
+	return &otlpExportRequest{
+		ResourceMetrics: []otlpResourceMetrics{
+			{
+				Resource: resource,
+				ScopeMetrics: []otlpScopeMetrics{
+					{
+						Scope:   otlpScope{Name: s.config.ScopeName},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// merge accumulates a data point for the same series, keeping the original start time.
+func (p *otlpPoint) merge(other *otlpPoint) {
+	p.value += other.value
+	p.decreasing = p.decreasing || other.decreasing
+	if p.kind != otlpKindHistogram {
+		return
+	}
+	if other.count == 0 {
+		return
+	}
+	if p.count == 0 {
+		p.min, p.max = other.min, other.max
+	} else {
+		p.min, p.max = math.Min(p.min, other.min), math.Max(p.max, other.max)
+	}
+	p.count += other.count
+	p.sum += other.sum
+	for i := range p.bucketCounts {
+		p.bucketCounts[i] += other.bucketCounts[i]
+	}
+}
+
+// otlpAttributes converts tags to attributes, sorted by key, omitting tags with no values.
+func otlpAttributes(tags map[string][]string) []otlpKeyValue {
+	keys := BucketInfo{Tags: tags}.sortedTagKeys()
+	attributes := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		values := tags[k]
+		switch len(values) {
+		case 0:
+		case 1:
+			attributes = append(attributes, otlpKeyValue{Key: k, Value: otlpStringValue(values[0])})
+		default:
+			array := &otlpArrayValue{Values: make([]otlpAnyValue, len(values))}
+			for i, v := range values {
+				array.Values[i] = otlpStringValue(v)
+			}
+			attributes = append(attributes, otlpKeyValue{Key: k, Value: otlpAnyValue{ArrayValue: array}})
+		}
+	}
+	return attributes
+}
+
+func otlpStringValue(s string) otlpAnyValue {
+	return otlpAnyValue{StringValue: &s}
+}
+
+func (v otlpUint64) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatUint(uint64(v), 10) + `"`), nil
+}
+
+func (v *otlpUint64) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = otlpUint64(n)
+	return nil
+}
+
+func (r *otlpExportRequest) marshalProto() []byte {
+	var p protoBuffer
+	for _, v := range r.ResourceMetrics {
+		p.message(1, v.marshalProto)
+	}
+	return p.b
+}
+
+func (r otlpResourceMetrics) marshalProto(p *protoBuffer) {
+	p.message(1, r.Resource.marshalProto)
+	for _, v := range r.ScopeMetrics {
+		p.message(2, v.marshalProto)
+	}
+}
+
+func (r otlpResource) marshalProto(p *protoBuffer) {
+	for _, v := range r.Attributes {
+		p.message(1, v.marshalProto)
+	}
+}
+
+func (m otlpScopeMetrics) marshalProto(p *protoBuffer) {
+	p.message(1, func(p *protoBuffer) {
+		p.string(1, m.Scope.Name)
+	})
+	for _, v := range m.Metrics {
+		p.message(2, v.marshalProto)
+	}
+}
+
+func (m otlpMetric) marshalProto(p *protoBuffer) {
+	p.string(1, m.Name)
+	p.string(2, m.Description)
+	p.string(3, m.Unit)
+	switch {
+	case m.Gauge != nil:
+		p.message(5, func(p *protoBuffer) {
+			for _, v := range m.Gauge.DataPoints {
+				p.message(1, v.marshalProto)
+			}
+		})
+	case m.Sum != nil:
+		p.message(7, func(p *protoBuffer) {
+			for _, v := range m.Sum.DataPoints {
+				p.message(1, v.marshalProto)
+			}
+			p.uint64(2, uint64(m.Sum.AggregationTemporality))
+			if m.Sum.IsMonotonic {
+				p.uint64(3, 1)
+			}
+		})
+	case m.Histogram != nil:
+		p.message(9, func(p *protoBuffer) {
+			for _, v := range m.Histogram.DataPoints {
+				p.message(1, v.marshalProto)
+			}
+			p.uint64(2, uint64(m.Histogram.AggregationTemporality))
+		})
+	}
+}
+
+func (d otlpNumberDataPoint) marshalProto(p *protoBuffer) {
+	p.fixed64(2, uint64(d.StartTimeUnixNano))
+	p.fixed64(3, uint64(d.TimeUnixNano))
+	// as_double is part of a oneof, so it must be encoded even if it is zero
+	p.double(4, d.AsDouble)
+	for _, v := range d.Attributes {
+		p.message(7, v.marshalProto)
+	}
+}
+
+func (d otlpHistogramDataPoint) marshalProto(p *protoBuffer) {
+	p.fixed64(2, uint64(d.StartTimeUnixNano))
+	p.fixed64(3, uint64(d.TimeUnixNano))
+	p.fixed64(4, uint64(d.Count))
+	// sum, min and max are optional fields, so they must be encoded even if they are zero
+	p.double(5, d.Sum)
+	p.packed(6, len(d.BucketCounts), func(i int) uint64 { return uint64(d.BucketCounts[i]) })
+	p.packed(7, len(d.ExplicitBounds), func(i int) uint64 { return math.Float64bits(d.ExplicitBounds[i]) })
+	for _, v := range d.Attributes {
+		p.message(9, v.marshalProto)
+	}
+	p.double(11, d.Min)
+	p.double(12, d.Max)
+}
+
+func (kv otlpKeyValue) marshalProto(p *protoBuffer) {
+	p.string(1, kv.Key)
+	p.message(2, kv.Value.marshalProto)
+}
+
+func (v otlpAnyValue) marshalProto(p *protoBuffer) {
+	switch {
+	case v.StringValue != nil:
+		// string_value is part of a oneof, so it must be encoded even if it is empty
+		p.tag(1, 2)
+		p.varint(uint64(len(*v.StringValue)))
+		p.b = append(p.b, *v.StringValue...)
+	case v.ArrayValue != nil:
+		p.message(5, func(p *protoBuffer) {
+			for _, v := range v.ArrayValue.Values {
+				p.message(1, v.marshalProto)
+			}
+		})
+	}
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+func (p *protoBuffer) tag(field int, wireType int) {
+	p.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// uint64 encodes a varint field, omitting the default value.
+func (p *protoBuffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, 0)
+	p.varint(v)
+}
+
+// fixed64 encodes a fixed64 field, omitting the default value.
+func (p *protoBuffer) fixed64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, 1)
+	p.b = binary.LittleEndian.AppendUint64(p.b, v)
+}
+
+// double encodes a double field, including the default value, see the callers.
+func (p *protoBuffer) double(field int, v float64) {
+	p.tag(field, 1)
+	p.b = binary.LittleEndian.AppendUint64(p.b, math.Float64bits(v))
+}
+
+// string encodes a string field, omitting the default value.
+func (p *protoBuffer) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	p.tag(field, 2)
+	p.varint(uint64(len(s)))
+	p.b = append(p.b, s...)
+}
+
+// packed encodes a packed repeated field of n 64 bit values, e.g. fixed64 or double.
+func (p *protoBuffer) packed(field int, n int, value func(i int) uint64) {
+	if n == 0 {
+		return
+	}
+	p.tag(field, 2)
+	p.varint(uint64(n * 8))
+	for i := 0; i < n; i++ {
+		p.b = binary.LittleEndian.AppendUint64(p.b, value(i))
+	}
+}
+
+// message encodes an embedded message field, which is always encoded, even if it is empty.
+func (p *protoBuffer) message(field int, marshal func(p *protoBuffer)) {
+	var m protoBuffer
+	marshal(&m)
+	p.tag(field, 2)
+	p.varint(uint64(len(m.b)))
+	p.b = append(p.b, m.b...)
+}
@@ -0,0 +1,465 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+type otlpTestReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []*otlpExportRequest
+	bodies   [][]byte
+	status   []int
+}
+
+func newOTLPTestReceiver(t *testing.T) *otlpTestReceiver {
+	r := &otlpTestReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if len(r.status) != 0 {
+			status := r.status[0]
+			r.status = r.status[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		r.bodies = append(r.bodies, b)
+		if req.Header.Get("Content-Type") == "application/json" {
+			var request otlpExportRequest
+			if err := json.Unmarshal(b, &request); err != nil {
+				t.Error(err)
+			}
+			r.requests = append(r.requests, &request)
+		}
+	}))
+	return r
+}
+
+func (r *otlpTestReceiver) take() ([]*otlpExportRequest, [][]byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	requests, bodies := r.requests, r.bodies
+	r.requests, r.bodies = nil, nil
+	return requests, bodies
+}
+
+func otlpTestString(s string) *string {
+	return &s
+}
+
+func TestOTLPService_json(t *testing.T) {
+	start := time.Unix(100, 0)
+	defer stubTimeNow(start)()
+
+	receiver := newOTLPTestReceiver(t)
+	defer receiver.Close()
+
+	s := NewOTLPService(OTLPConfig{
+		Endpoint:        receiver.URL,
+		Client:          receiver.Client(),
+		Header:          http.Header{"Authorization": {"token"}},
+		JSON:            true,
+		HistogramBounds: []float64{1, 10},
+		Resource:        map[string]string{"service.name": "svc"},
+		Interval:        -1,
+	})
+
+	s.Bucket("requests").Tag("status", "200").Count(2)
+	s.Bucket("requests").Tag("status", "200").Increment()
+	s.Bucket("queue").Gauge(3)
+	s.Bucket("users").Unique("a")
+	s.Bucket("users").Unique("a")
+	s.Bucket("size").Tag("region", "a", "b").Histogram(0.5)
+	s.Bucket("size").Tag("region", "a", "b").Histogram(5)
+	s.Bucket("size").Tag("region", "a", "b").Histogram(50)
+	s.Bucket("latency").Timing(time.Millisecond * 20)
+
+	defer stubTimeNow(time.Unix(110, 0))()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, _ := receiver.take()
+
+	const (
+		startNanos = otlpUint64(100e9)
+		endNanos   = otlpUint64(110e9)
+	)
+
+	if diff := deep.Equal(
+		requests,
+		[]*otlpExportRequest{
+			{
+				ResourceMetrics: []otlpResourceMetrics{
+					{
+						Resource: otlpResource{
+							Attributes: []otlpKeyValue{
+								{Key: "service.name", Value: otlpAnyValue{StringValue: otlpTestString("svc")}},
+							},
+						},
+						ScopeMetrics: []otlpScopeMetrics{
+							{
+								Scope: otlpScope{Name: "github.com/joeycumines/go-appstats"},
+								Metrics: []otlpMetric{
+									{
+										Name: "latency",
+										Unit: "ms",
+										Histogram: &otlpHistogram{
+											AggregationTemporality: OTLPTemporalityDelta,
+											DataPoints: []otlpHistogramDataPoint{
+												{
+													StartTimeUnixNano: startNanos,
+													TimeUnixNano:      endNanos,
+													Count:             1,
+													Sum:               20,
+													BucketCounts:      []otlpUint64{0, 0, 1},
+													ExplicitBounds:    []float64{1, 10},
+													Min:               20,
+													Max:               20,
+												},
+											},
+										},
+									},
+									{
+										Name: "queue",
+										Gauge: &otlpGauge{
+											DataPoints: []otlpNumberDataPoint{
+												{TimeUnixNano: endNanos, AsDouble: 3},
+											},
+										},
+									},
+									{
+										Name: "requests",
+										Sum: &otlpSum{
+											AggregationTemporality: OTLPTemporalityDelta,
+											IsMonotonic:            true,
+											DataPoints: []otlpNumberDataPoint{
+												{
+													Attributes: []otlpKeyValue{
+														{Key: "status", Value: otlpAnyValue{StringValue: otlpTestString("200")}},
+													},
+													StartTimeUnixNano: startNanos,
+													TimeUnixNano:      endNanos,
+													AsDouble:          3,
+												},
+											},
+										},
+									},
+									{
+										Name: "size",
+										Histogram: &otlpHistogram{
+											AggregationTemporality: OTLPTemporalityDelta,
+											DataPoints: []otlpHistogramDataPoint{
+												{
+													Attributes: []otlpKeyValue{
+														{Key: "region", Value: otlpAnyValue{ArrayValue: &otlpArrayValue{
+															Values: []otlpAnyValue{
+																{StringValue: otlpTestString("a")},
+																{StringValue: otlpTestString("b")},
+															},
+														}}},
+													},
+													StartTimeUnixNano: startNanos,
+													TimeUnixNano:      endNanos,
+													Count:             3,
+													Sum:               55.5,
+													BucketCounts:      []otlpUint64{1, 1, 1},
+													ExplicitBounds:    []float64{1, 10},
+													Min:               0.5,
+													Max:               50,
+												},
+											},
+										},
+									},
+									{
+										Name: "users",
+										Gauge: &otlpGauge{
+											DataPoints: []otlpNumberDataPoint{
+												{TimeUnixNano: endNanos, AsDouble: 1},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOTLPService_cumulative(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	receiver := newOTLPTestReceiver(t)
+	defer receiver.Close()
+
+	s := NewOTLPService(OTLPConfig{
+		Endpoint:    receiver.URL,
+		Client:      receiver.Client(),
+		JSON:        true,
+		Temporality: OTLPTemporalityCumulative,
+		Interval:    -1,
+	})
+
+	values := func() []float64 {
+		requests, _ := receiver.take()
+		var values []float64
+		for _, request := range requests {
+			for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+				if metric.Sum.AggregationTemporality != OTLPTemporalityCumulative {
+					t.Error("unexpected temporality", metric.Sum.AggregationTemporality)
+				}
+				for _, point := range metric.Sum.DataPoints {
+					if point.StartTimeUnixNano != 100e9 {
+						t.Error("unexpected start", point.StartTimeUnixNano)
+					}
+					values = append(values, point.AsDouble)
+				}
+			}
+		}
+		return values
+	}
+
+	s.Bucket("a").Count(2)
+	s.Bucket("b").Count(1)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(values(), []float64{2, 1}); diff != nil {
+		t.Error(diff)
+	}
+
+	defer stubTimeNow(time.Unix(110, 0))()
+
+	s.Bucket("a").Count(3)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(values(), []float64{5, 1}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOTLPService_nonMonotonic(t *testing.T) {
+	for _, temporality := range []OTLPTemporality{OTLPTemporalityDelta, OTLPTemporalityCumulative} {
+		receiver := newOTLPTestReceiver(t)
+
+		s := NewOTLPService(OTLPConfig{
+			Endpoint:    receiver.URL,
+			Client:      receiver.Client(),
+			JSON:        true,
+			Temporality: temporality,
+			Interval:    -1,
+		})
+
+		monotonic := func() map[string]bool {
+			requests, _ := receiver.take()
+			r := make(map[string]bool)
+			for _, request := range requests {
+				for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+					r[metric.Name] = metric.Sum.IsMonotonic
+				}
+			}
+			return r
+		}
+
+		s.Bucket("a").Count(2)
+		s.Bucket("a").Count(-1)
+		s.Bucket("b").Count(1)
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(monotonic(), map[string]bool{"a": false, "b": true}); diff != nil {
+			t.Error(temporality, diff)
+		}
+
+		s.Bucket("a").Increment()
+		s.Bucket("b").Increment()
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]bool{"a": true, "b": true}
+		if temporality == OTLPTemporalityCumulative {
+			// the cumulative value has decreased
+			expected["a"] = false
+		}
+		if diff := deep.Equal(monotonic(), expected); diff != nil {
+			t.Error(temporality, diff)
+		}
+
+		receiver.Close()
+	}
+}
+
+func TestOTLPService_metadata(t *testing.T) {
+	receiver := newOTLPTestReceiver(t)
+	defer receiver.Close()
+
+	s := NewOTLPService(OTLPConfig{
+		Endpoint: receiver.URL,
+		Client:   receiver.Client(),
+		JSON:     true,
+		Interval: -1,
+		Metadata: NewMetadataRegistry(
+			MetricMetadata{Name: "size", Unit: "By", Description: "The size of each request."},
+			MetricMetadata{Name: "latency", Unit: "s", Description: "The latency of each request."},
+		),
+	})
+
+	s.Bucket("queue").Gauge(3)
+	s.Bucket("size").Histogram(5)
+	s.Bucket("latency").Timing(time.Millisecond * 20)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, _ := receiver.take()
+	if len(requests) != 1 {
+		t.Fatal("unexpected requests", requests)
+	}
+
+	var metrics []string
+	for _, metric := range requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics = append(metrics, metric.Name+" "+metric.Unit+" "+metric.Description)
+	}
+	if diff := deep.Equal(
+		metrics,
+		[]string{
+			"latency ms The latency of each request.",
+			"queue  ",
+			"size By The size of each request.",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOTLPService_batchingAndRetry(t *testing.T) {
+	receiver := newOTLPTestReceiver(t)
+	defer receiver.Close()
+
+	receiver.status = []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+
+	s := NewOTLPService(OTLPConfig{
+		Endpoint:     receiver.URL,
+		Client:       receiver.Client(),
+		JSON:         true,
+		Interval:     -1,
+		MaxBatchSize: 2,
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	})
+
+	s.Bucket("a").Increment()
+	s.Bucket("b").Increment()
+	s.Bucket("c").Increment()
+
+	if err := s.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+
+	requests, _ := receiver.take()
+	if len(requests) != 1 {
+		t.Fatal("unexpected requests", len(requests))
+	}
+	if n := len(requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics); n != 2 {
+		t.Error("unexpected metrics", n)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Error(err)
+	}
+	if requests, _ := receiver.take(); len(requests) != 0 {
+		t.Error("unexpected requests", len(requests))
+	}
+}
+
+func TestOTLPService_protobuf(t *testing.T) {
+	defer stubTimeNow(time.Unix(1, 0))()
+
+	receiver := newOTLPTestReceiver(t)
+	defer receiver.Close()
+
+	s := NewOTLPService(OTLPConfig{
+		Endpoint: receiver.URL,
+		Client:   receiver.Client(),
+		Interval: -1,
+	})
+
+	s.Bucket("a").Tag("k", "v").Increment()
+
+	defer stubTimeNow(time.Unix(2, 0))()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, bodies := receiver.take()
+	if len(bodies) != 1 {
+		t.Fatal("unexpected bodies", len(bodies))
+	}
+
+	// verified against the generated go.opentelemetry.io/proto/otlp types
+	const expected = "0a5c0a0012580a240a226769746875622e636f6d2f6a6f657963756d696e6573" +
+		"2f676f2d617070737461747312300a01613a2b0a251100ca9a3b000000001900" +
+		"9435770000000021000000000000f03f3a080a016b12030a017610011801"
+
+	if diff := deep.Equal(hex.EncodeToString(bodies[0]), expected); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOTLPUint64_json(t *testing.T) {
+	b, err := json.Marshal([]otlpUint64{0, 18446744073709551615})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `["0","18446744073709551615"]` {
+		t.Error(string(b))
+	}
+	var v []otlpUint64
+	if err := json.Unmarshal([]byte(`["1",2]`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(v, []otlpUint64{1, 2}); diff != nil {
+		t.Error(diff)
+	}
+}
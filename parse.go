@@ -0,0 +1,197 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseBucketKey is the inverse of the key funcs built using NewBucketKeyFunc, and parses keys like
+// "bucket,tag1=a,tag2=b" into a BucketInfo, repeated tags will append values, and tags without a "=" will be present
+// but have no values. Note that there is no escaping, as the key funcs don't escape, but rather sanitise, meaning a
+// backslash is just a backslash, and that since the sanitisation is lossy, this will not necessarily reconstruct the
+// original BucketInfo, only an equivalent one, that will generate the same key.
+func ParseBucketKey(key string) (BucketInfo, error) {
+	parts := strings.Split(key, ",")
+	info, err := newParsedBucketInfo(parts[0], len(parts)-1)
+	if err != nil {
+		return BucketInfo{}, fmt.Errorf("appstats.ParseBucketKey %s", err.Error())
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if kv[0] == "" {
+			return BucketInfo{}, errors.New("appstats.ParseBucketKey empty tag key")
+		}
+		addParsedTag(info.Tags, kv)
+	}
+	return info, nil
+}
+
+// ParseInfluxBucketKey is the inverse of NewInfluxBucketKeyFunc, and is like ParseBucketKey, except that any
+// character may be escaped with a backslash, e.g. "my\ bucket,tag\,1=a\=b", as per the line protocol.
+func ParseInfluxBucketKey(key string) (BucketInfo, error) {
+	info, err := parseEscapedBucketKey(key, true)
+	if err != nil {
+		return BucketInfo{}, fmt.Errorf("appstats.ParseInfluxBucketKey %s", err.Error())
+	}
+	return info, nil
+}
+
+// ParseDogStatsDBucketKey parses keys in the DogStatsD tagged form, like "bucket|#tag1:a,tag2:b", or just "bucket",
+// into a BucketInfo, repeated tags will append values, and tags without a ":" will be present but have no values.
+func ParseDogStatsDBucketKey(key string) (BucketInfo, error) {
+	var (
+		bucket = key
+		tags   []string
+	)
+	if i := strings.Index(key, "|#"); i >= 0 {
+		bucket = key[:i]
+		tags = strings.Split(key[i+2:], ",")
+	}
+	info, err := newParsedBucketInfo(bucket, len(tags))
+	if err != nil {
+		return BucketInfo{}, fmt.Errorf("appstats.ParseDogStatsDBucketKey %s", err.Error())
+	}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if kv[0] == "" {
+			return BucketInfo{}, errors.New("appstats.ParseDogStatsDBucketKey empty tag key")
+		}
+		addParsedTag(info.Tags, kv)
+	}
+	return info, nil
+}
+
+// ParseGraphiteBucketKey parses keys in the Graphite tagged series form, like "bucket;tag1=a;tag2=b", into a
+// BucketInfo, repeated tags will append values, and tags without a "=" will be present but have no values.
+func ParseGraphiteBucketKey(key string) (BucketInfo, error) {
+	parts := strings.Split(key, ";")
+	info, err := newParsedBucketInfo(parts[0], len(parts)-1)
+	if err != nil {
+		return BucketInfo{}, fmt.Errorf("appstats.ParseGraphiteBucketKey %s", err.Error())
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if kv[0] == "" {
+			return BucketInfo{}, errors.New("appstats.ParseGraphiteBucketKey empty tag key")
+		}
+		addParsedTag(info.Tags, kv)
+	}
+	return info, nil
+}
+
+// parseEscapedBucketKey parses the canonical text encoding of BucketInfo, which is like the format accepted by
+// ParseBucketKey, except that any character may be escaped with a backslash, e.g. "tag\,1=a\=b", and it will also
+// accept an empty bucket and empty tag keys, if strict is false.
+func parseEscapedBucketKey(key string, strict bool) (BucketInfo, error) {
+	parts := splitEscaped(key, ',', -1)
+	info := BucketInfo{
+		Bucket: unescape(parts[0]),
+	}
+	if strict && info.Bucket == "" {
+		return BucketInfo{}, errors.New("empty bucket")
+	}
+	if len(parts) > 1 {
+		info.Tags = make(map[string][]string, len(parts)-1)
+	}
+	for _, part := range parts[1:] {
+		kv := splitEscaped(part, '=', 2)
+		for i := range kv {
+			kv[i] = unescape(kv[i])
+		}
+		if strict && kv[0] == "" {
+			return BucketInfo{}, errors.New("empty tag key")
+		}
+		addParsedTag(info.Tags, kv)
+	}
+	return info, nil
+}
+
+func newParsedBucketInfo(bucket string, tags int) (BucketInfo, error) {
+	if bucket == "" {
+		return BucketInfo{}, errors.New("empty bucket")
+	}
+	info := BucketInfo{
+		Bucket: bucket,
+	}
+	if tags > 0 {
+		info.Tags = make(map[string][]string, tags)
+	}
+	return info, nil
+}
+
+// addParsedTag adds a tag from kv, which must contain the key, and optionally a single value.
+func addParsedTag(tags map[string][]string, kv []string) {
+	if _, ok := tags[kv[0]]; !ok {
+		tags[kv[0]] = make([]string, 0, len(kv)-1)
+	}
+	tags[kv[0]] = append(tags[kv[0]], kv[1:]...)
+}
+
+// escape escapes backslashes and any of the runes in special with a backslash, the inverse of unescape.
+func escape(s string, special string) string {
+	if !strings.ContainsAny(s, special) && strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s)+8)
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b = append(b, '\\')
+		}
+		b = append(b, string(r)...)
+	}
+	return string(b)
+}
+
+// splitEscaped splits s on every unescaped sep, like strings.SplitN, note that escapes are not removed.
+func splitEscaped(s string, sep byte, n int) []string {
+	var (
+		parts  []string
+		start  int
+		escape bool
+	)
+	for i := 0; i < len(s) && n != len(parts)+1; i++ {
+		switch {
+		case escape:
+			escape = false
+		case s[i] == '\\':
+			escape = true
+		case s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescape removes backslash escapes, a trailing backslash is retained.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"github.com/go-test/deep"
+	"testing"
+)
+
+func TestParseBucketKey(t *testing.T) {
+	testCases := []struct {
+		Key  string
+		Info BucketInfo
+		Err  string
+	}{
+		{
+			Key: "",
+			Err: "appstats.ParseBucketKey empty bucket",
+		},
+		{
+			Key: ",a=b",
+			Err: "appstats.ParseBucketKey empty bucket",
+		},
+		{
+			Key: "bucket,=b",
+			Err: "appstats.ParseBucketKey empty tag key",
+		},
+		{
+			Key: "bucket,a=b,,c=d",
+			Err: "appstats.ParseBucketKey empty tag key",
+		},
+		{
+			Key:  "bucket",
+			Info: BucketInfo{Bucket: "bucket"},
+		},
+		{
+			Key: "bucket_one.two-tree,one_two=value_1_,tag_3=two,ñ=adads",
+			Info: BucketInfo{
+				Bucket: "bucket_one.two-tree",
+				Tags: map[string][]string{
+					"one_two": {"value_1_"},
+					"tag_3":   {"two"},
+					"ñ":       {"adads"},
+				},
+			},
+		},
+		{
+			Key: "bucket,a=one,a=two,b,c=,d=x=y",
+			Info: BucketInfo{
+				Bucket: "bucket",
+				Tags: map[string][]string{
+					"a": {"one", "two"},
+					"b": {},
+					"c": {""},
+					"d": {"x=y"},
+				},
+			},
+		},
+		{
+			Key: `my\bucket,tag\1=a\=b,\\=\`,
+			Info: BucketInfo{
+				Bucket: `my\bucket`,
+				Tags: map[string][]string{
+					`tag\1`: {`a\=b`},
+					`\\`:    {`\`},
+				},
+			},
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestParseBucketKey_#%d", i+1)
+
+		info, err := ParseBucketKey(testCase.Key)
+
+		if (err == nil) != (testCase.Err == "") || (err != nil && err.Error() != testCase.Err) {
+			t.Error(name, "err", "expected =", testCase.Err, "actual =", err)
+		}
+
+		if diff := deep.Equal(info, testCase.Info); diff != nil {
+			t.Error(name, "info", diff)
+		}
+	}
+}
+
+func TestParseBucketKey_roundTrip(t *testing.T) {
+	for _, testCase := range []struct {
+		KeyFunc BucketKeyFunc
+		Info    BucketInfo
+	}{
+		{
+			KeyFunc: DefaultBucketKeyFunc,
+			Info: BucketInfo{
+				Bucket: "!BUCKET_one.TWO-tree",
+				Tags: map[string][]string{
+					"  ONE!two": {"12vaLue_1!"},
+					"tag_3":     {"one", "   TWO"},
+					"ñ":         {"", "adads:"},
+				},
+			},
+		},
+		{
+			KeyFunc: NewBucketKeyFunc(SanitiseKey, BucketKeyTagValues(TagValuesAll)),
+			Info: BucketInfo{
+				Bucket: "!BUCKET_one.TWO-tree",
+				Tags: map[string][]string{
+					"  ONE!two": {"12vaLue_1!"},
+					"tag_3":     {"one", "   TWO"},
+					"ñ":         {"", "adads:"},
+				},
+			},
+		},
+		{
+			KeyFunc: DefaultBucketKeyFunc,
+			Info: BucketInfo{
+				Bucket: `a\b`,
+				Tags: map[string][]string{
+					"path": {`c\d`},
+				},
+			},
+		},
+	} {
+		keyFunc := testCase.KeyFunc
+		key, ok := keyFunc(testCase.Info)
+		if !ok {
+			t.Fatal(key)
+		}
+		info, err := ParseBucketKey(key)
+		if err != nil {
+			t.Fatal(key, err)
+		}
+		if parsed, ok := keyFunc(info); parsed != key || !ok {
+			t.Error(key, parsed, ok)
+		}
+	}
+}
+
+func TestParseDogStatsDBucketKey(t *testing.T) {
+	testCases := []struct {
+		Key  string
+		Info BucketInfo
+		Err  string
+	}{
+		{
+			Key: "|#a:b",
+			Err: "appstats.ParseDogStatsDBucketKey empty bucket",
+		},
+		{
+			Key: "bucket|#a:b,:c",
+			Err: "appstats.ParseDogStatsDBucketKey empty tag key",
+		},
+		{
+			Key:  "bucket",
+			Info: BucketInfo{Bucket: "bucket"},
+		},
+		{
+			Key: "bucket.name|#env:prod,region:us-east-1,region:b:c,flag",
+			Info: BucketInfo{
+				Bucket: "bucket.name",
+				Tags: map[string][]string{
+					"env":    {"prod"},
+					"region": {"us-east-1", "b:c"},
+					"flag":   {},
+				},
+			},
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestParseDogStatsDBucketKey_#%d", i+1)
+
+		info, err := ParseDogStatsDBucketKey(testCase.Key)
+
+		if (err == nil) != (testCase.Err == "") || (err != nil && err.Error() != testCase.Err) {
+			t.Error(name, "err", "expected =", testCase.Err, "actual =", err)
+		}
+
+		if diff := deep.Equal(info, testCase.Info); diff != nil {
+			t.Error(name, "info", diff)
+		}
+	}
+}
+
+func TestParseGraphiteBucketKey(t *testing.T) {
+	testCases := []struct {
+		Key  string
+		Info BucketInfo
+		Err  string
+	}{
+		{
+			Key: ";a=b",
+			Err: "appstats.ParseGraphiteBucketKey empty bucket",
+		},
+		{
+			Key: "bucket;=b",
+			Err: "appstats.ParseGraphiteBucketKey empty tag key",
+		},
+		{
+			Key:  "some.path",
+			Info: BucketInfo{Bucket: "some.path"},
+		},
+		{
+			Key: "some.path;env=prod;expr=a=b;env=dev",
+			Info: BucketInfo{
+				Bucket: "some.path",
+				Tags: map[string][]string{
+					"env":  {"prod", "dev"},
+					"expr": {"a=b"},
+				},
+			},
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestParseGraphiteBucketKey_#%d", i+1)
+
+		info, err := ParseGraphiteBucketKey(testCase.Key)
+
+		if (err == nil) != (testCase.Err == "") || (err != nil && err.Error() != testCase.Err) {
+			t.Error(name, "err", "expected =", testCase.Err, "actual =", err)
+		}
+
+		if diff := deep.Equal(info, testCase.Info); diff != nil {
+			t.Error(name, "info", diff)
+		}
+	}
+}
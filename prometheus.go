@@ -0,0 +1,124 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"strings"
+)
+
+var (
+	prometheusNameSanitiser = NewSanitiser(
+		SanitiserLeading(AnyRuneClass(isASCIILetter, RuneClassOf("_:"))),
+		SanitiserAllowed(AnyRuneClass(isASCIILetter, isASCIIDigit, RuneClassOf("_:"))),
+		SanitiserReplacement('_'),
+		SanitiserCollapse(),
+	)
+
+	prometheusLabelSanitiser = NewSanitiser(
+		SanitiserLeading(AnyRuneClass(isASCIILetter, RuneClassOf("_"))),
+		SanitiserAllowed(AnyRuneClass(isASCIILetter, isASCIIDigit, RuneClassOf("_"))),
+		SanitiserReplacement('_'),
+		SanitiserCollapse(),
+	)
+
+	prometheusLabelValueEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+	)
+
+	prometheusBucketKeyFormat = bucketKeyFormat{
+		first:  "{",
+		next:   ",",
+		assign: "=",
+		quote:  `"`,
+		last:   "}",
+	}
+)
+
+// NewPrometheusBucketKeyFunc returns a key func generating Prometheus series, in the exposition format, like
+// `name{label1="value",label2="value"}`, using PrometheusKeySanitisers, note that since Prometheus doesn't support
+// repeated labels, the default TagValuesFunc is still TagValuesLast, and that empty label values are omitted, as
+// they are equivalent to a missing label.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func NewPrometheusBucketKeyFunc(opts ...BucketKeyOption) BucketKeyFunc {
+	return newBucketKeyFunc(prometheusBucketKeyFormat, PrometheusKeySanitisers(), opts...)
+}
+
+// PrometheusKeySanitisers returns the sanitisers used by NewPrometheusBucketKeyFunc, which are SanitisePrometheusName,
+// SanitisePrometheusLabel, and EscapePrometheusLabelValue.
+func PrometheusKeySanitisers() KeySanitisers {
+	return KeySanitisers{
+		Bucket:   SanitisePrometheusName,
+		TagKey:   SanitisePrometheusLabel,
+		TagValue: EscapePrometheusLabelValue,
+	}
+}
+
+// SanitisePrometheusName sanitises a metric name to match `[a-zA-Z_:][a-zA-Z0-9_:]*`, dropping any leading runes
+// that cannot start a name, and replacing any other invalid runes, e.g. `-`, `.`, and `/`, with a single '_'.
+// https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+func SanitisePrometheusName(value string) string {
+	return prometheusNameSanitiser(value)
+}
+
+// SanitisePrometheusLabel sanitises a label name like SanitisePrometheusName, but to match `[a-zA-Z_][a-zA-Z0-9_]*`,
+// and ensures it doesn't start with the reserved `__` prefix, by collapsing any leading underscores.
+func SanitisePrometheusLabel(value string) string {
+	value = prometheusLabelSanitiser(value)
+	if strings.HasPrefix(value, "__") {
+		value = "_" + strings.TrimLeft(value, "_")
+	}
+	return value
+}
+
+// EscapePrometheusLabelValue escapes backslashes, double quotes, and newlines, as required for label values in the
+// Prometheus text exposition format.
+func EscapePrometheusLabelValue(value string) string {
+	return prometheusLabelValueEscaper.Replace(value)
+}
+
+// PrometheusMetricName sanitises name using SanitisePrometheusName, then applies the naming conventions for the
+// metric type and (base) unit, e.g. ("http.request.duration", MetricTiming, "seconds") returns
+// "http_request_duration_seconds", and ("http.requests", MetricCount, "") returns "http_requests_total", note that
+// suffixes are not repeated, if name already has them.
+// https://prometheus.io/docs/practices/naming/
+func PrometheusMetricName(name string, metricType MetricType, unit string) string {
+	name = SanitisePrometheusName(name)
+	if name == "" {
+		return ""
+	}
+	if metricType == MetricCount {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	if unit = SanitisePrometheusLabel(unit); unit != "" && !strings.HasSuffix(name, "_"+unit) {
+		name += "_" + strings.TrimLeft(unit, "_")
+	}
+	if metricType == MetricCount {
+		name += "_total"
+	}
+	return name
+}
+
+func isASCIILetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isASCIIDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
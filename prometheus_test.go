@@ -0,0 +1,159 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSanitisePrometheusName(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output string
+	}{
+		{Input: "", Output: ""},
+		{Input: "http_requests_total", Output: "http_requests_total"},
+		{Input: "http.requests-total", Output: "http_requests_total"},
+		{Input: `a/b\c`, Output: "a_b_c"},
+		{Input: "200 requests", Output: "requests"},
+		{Input: ":recording:rule", Output: ":recording:rule"},
+		{Input: "Ñame.ñ", Output: "ame_"},
+		{Input: "CamelCase", Output: "CamelCase"},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSanitisePrometheusName_#%d", i+1)
+
+		output := SanitisePrometheusName(testCase.Input)
+
+		if output != testCase.Output {
+			t.Error(name, "output", "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestSanitisePrometheusLabel(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output string
+	}{
+		{Input: "", Output: ""},
+		{Input: "status_code", Output: "status_code"},
+		{Input: "status:code", Output: "status_code"},
+		{Input: "__name__", Output: "_name__"},
+		{Input: "___", Output: "_"},
+		{Input: "_private", Output: "_private"},
+		{Input: "1st", Output: "st"},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSanitisePrometheusLabel_#%d", i+1)
+
+		output := SanitisePrometheusLabel(testCase.Input)
+
+		if output != testCase.Output {
+			t.Error(name, "output", "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestEscapePrometheusLabelValue(t *testing.T) {
+	if output := EscapePrometheusLabelValue("a\\b\"c\nd"); output != `a\\b\"c\nd` {
+		t.Error(output)
+	}
+}
+
+func TestPrometheusMetricName(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Type   MetricType
+		Unit   string
+		Output string
+	}{
+		{Name: "", Type: MetricCount, Output: ""},
+		{Name: "http.requests", Type: MetricCount, Output: "http_requests_total"},
+		{Name: "http.requests_total", Type: MetricCount, Output: "http_requests_total"},
+		{Name: "http.request.duration", Type: MetricTiming, Unit: "seconds", Output: "http_request_duration_seconds"},
+		{Name: "request_size_bytes", Type: MetricHistogram, Unit: "bytes", Output: "request_size_bytes"},
+		{Name: "sent", Type: MetricCount, Unit: "bytes", Output: "sent_bytes_total"},
+		{Name: "memory", Type: MetricGauge, Unit: "__bytes", Output: "memory_bytes"},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestPrometheusMetricName_#%d", i+1)
+
+		output := PrometheusMetricName(testCase.Name, testCase.Type, testCase.Unit)
+
+		if output != testCase.Output {
+			t.Error(name, "output", "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestNewPrometheusBucketKeyFunc(t *testing.T) {
+	testCases := []struct {
+		Info BucketInfo
+		Key  string
+		Ok   bool
+	}{
+		{
+			Info: BucketInfo{Bucket: "!!!"},
+			Key:  "",
+			Ok:   false,
+		},
+		{
+			Info: BucketInfo{Bucket: "http.requests"},
+			Key:  "http_requests",
+			Ok:   true,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: "http.requests",
+				Tags: map[string][]string{
+					"status":   {"404", "200"},
+					"path":     {`/a"b\c`},
+					"empty":    {""},
+					"__name__": {"x"},
+				},
+			},
+			Key: `http_requests{_name__="x",path="/a\"b\\c",status="200"}`,
+			Ok:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewPrometheusBucketKeyFunc_#%d", i+1)
+
+		key, ok := NewPrometheusBucketKeyFunc()(testCase.Info)
+
+		if key != testCase.Key {
+			t.Error(name, "key", "expected =", testCase.Key, "actual =", key)
+		}
+
+		if ok != testCase.Ok {
+			t.Error(name, "ok", "expected =", testCase.Ok, "actual =", ok)
+		}
+	}
+}
+
+func TestNewBucketKeyFunc_prometheusName(t *testing.T) {
+	if key, ok := NewBucketKeyFunc(SanitisePrometheusName)(BucketInfo{Bucket: "a.b", Tags: map[string][]string{"c-d": {"e/f"}}}); key != "a_b,c_d=e_f" || !ok {
+		t.Error(key, ok)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPushgatewayBuckets are the default histogram buckets, which are the same as the Prometheus client's
+// defaults, note that timings are converted to seconds.
+var DefaultPushgatewayBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type (
+	// PushgatewayConfig configures a Service created by NewPushgatewayService, note that only URL is required.
+	PushgatewayConfig struct {
+		// URL is the base URL of the Pushgateway, e.g. "http://localhost:9091".
+		URL string
+		// Job is the job label, which is the first part of the grouping key, it defaults to "appstats".
+		Job string
+		// Grouping is any other labels of the grouping key, e.g. "instance".
+		Grouping map[string]string
+		// Method is either http.MethodPut (the default), which replaces all metrics in the group, or
+		// http.MethodPost, which replaces only metrics with the same names.
+		Method string
+		// Client defaults to http.DefaultClient.
+		Client *http.Client
+		// Header will be added to each request, e.g. for authentication.
+		Header http.Header
+		// Buckets are the histogram bucket upper bounds, and default to DefaultPushgatewayBuckets.
+		Buckets []float64
+		// MaxRetries is the max number of times a failed request will be retried, it defaults to 3, and a negative
+		// value disables retries.
+		MaxRetries int
+		// RetryBackoff is the delay before the first retry, which doubles for each retry, it defaults to 1 second.
+		RetryBackoff time.Duration
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines counts series pushed, and StatDrops counts metrics dropped due to a collision, note that
+		// nothing else is dropped, as the state is cumulative.
+		Stats Bucket
+		// Metadata is an optional registry, which provides the HELP line of each metric family, from the
+		// description registered with the bucket name.
+		Metadata *MetadataRegistry
+	}
+
+	pushgatewayService struct {
+		config     PushgatewayConfig
+		url        string
+		sender     httpSender
+		stats      *selfStats
+		aggregator aggregator
+		flushMutex sync.Mutex
+		series     map[aggregateKey]*pushgatewaySeries
+		// families is the kind of each metric family, by name, samples is the family of each sample name, e.g.
+		// "x_count" for a histogram "x", and identities is the name and labels of every series, like `name{labels}`,
+		// which are used to detect collisions, which are recorded in collisions.
+		families   map[string]string
+		samples    map[string]string
+		identities map[string]struct{}
+		collisions map[aggregateKey]struct{}
+	}
+
+	// pushgatewaySeries is the cumulative state of a series, since the service started.
+	pushgatewaySeries struct {
+		// name is the metric family name.
+		name string
+		// labels is the rendered labels, without braces, e.g. `a="1",b="2"`.
+		labels  string
+		kind    string
+		help    string
+		value   float64
+		uniques map[string]struct{}
+		count   uint64
+		sum     float64
+		buckets []uint64
+	}
+)
+
+// NewPushgatewayService returns a Service for batch jobs, which aggregates metrics in-process, and on each Flush
+// (and Close), renders every metric, in the Prometheus text exposition format, and pushes them to a Pushgateway,
+// retrying with backoff. There is no background flushing, as the Pushgateway retains only the last push.
+//
+// Metric names are generated by PrometheusMetricName, and labels are generated like NewPrometheusBucketKeyFunc.
+// Counts are pushed as counters (with the "_total" suffix), gauges as gauges, uniques as gauges of the number of
+// distinct values, histograms as histograms, and timings as histograms in seconds (with the "_seconds" suffix), all
+// of which are cumulative, meaning a failed push loses no data, and is retried by the next Flush. Note that the
+// grouping labels (including job) should not also be used as tags, and that metrics that would generate the same
+// series as another, e.g. tag keys "a.b" and "a_b", or the same family with a different type, e.g. a bucket used for
+// both gauges and histograms, or the samples of a histogram, e.g. a gauge "x_count" and a histogram "x", or that would
+// use the reserved "le" label for a histogram, are dropped (as the Pushgateway would reject the entire push), with
+// an error returned by the Flush that first encountered them. If Metadata is set, each family with a registered
+// description will be preceded by a HELP line.
+// https://github.com/prometheus/pushgateway
+func NewPushgatewayService(config PushgatewayConfig) Service {
+	if config.Job == "" {
+		config.Job = "appstats"
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPut
+	}
+	if config.Buckets == nil {
+		config.Buckets = DefaultPushgatewayBuckets
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	return &pushgatewayService{
+		config: config,
+		url:    PushgatewayURL(config.URL, config.Job, config.Grouping),
+		sender: httpSender{
+			client:     config.Client,
+			maxRetries: config.MaxRetries,
+			backoff:    config.RetryBackoff,
+		},
+		stats:      newSelfStats(config.Stats),
+		aggregator: aggregator{values: true},
+		series:     make(map[aggregateKey]*pushgatewaySeries),
+		families:   make(map[string]string),
+		samples:    make(map[string]string),
+		identities: make(map[string]struct{}),
+		collisions: make(map[aggregateKey]struct{}),
+	}
+}
+
+// PushgatewayURL returns the URL for the grouping key, like "{base}/metrics/job/{job}/{label}/{value}", with
+// grouping labels sorted by name, and values that contain a '/', or are empty, encoded as base64.
+func PushgatewayURL(base, job string, grouping map[string]string) string {
+	var b strings.Builder
+	b.WriteString(strings.TrimSuffix(base, "/"))
+	b.WriteString("/metrics")
+	writePushgatewayLabel(&b, "job", job)
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writePushgatewayLabel(&b, name, grouping[name])
+	}
+	return b.String()
+}
+
+func writePushgatewayLabel(b *strings.Builder, name, value string) {
+	b.WriteByte('/')
+	b.WriteString(url.PathEscape(name))
+	switch {
+	case value == "":
+		b.WriteString("@base64/=")
+	case strings.Contains(value, "/"):
+		b.WriteString("@base64/")
+		b.WriteString(base64.URLEncoding.EncodeToString([]byte(value)))
+	default:
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(value))
+	}
+}
+
+// Bucket returns a new bucket, keyed by the canonical text encoding of its BucketInfo.
+func (s *pushgatewayService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, s.sample)
+}
+
+// Flush pushes every metric, if there are any.
+func (s *pushgatewayService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.flushed(timeNow())
+
+	var err error
+	for _, v := range s.aggregator.flush() {
+		if mergeErr := s.merge(v); mergeErr != nil {
+			s.stats.error()
+			if err == nil {
+				err = mergeErr
+			}
+		}
+	}
+
+	if len(s.series) == 0 {
+		return err
+	}
+
+	header := make(http.Header, len(s.config.Header)+1)
+	for k, v := range s.config.Header {
+		header[k] = v
+	}
+	header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	body := s.render()
+
+	if err := s.sender.send(s.config.Method, s.url, header, body); err != nil {
+		s.stats.error()
+		return fmt.Errorf("appstats.pushgatewayService.Flush send error: %s", err.Error())
+	}
+
+	s.stats.sent(len(s.series), len(body))
+
+	return err
+}
+
+// Close pushes every metric, see Flush.
+func (s *pushgatewayService) Close() error {
+	return s.Flush()
+}
+
+func (s *pushgatewayService) sample(sample Sample) {
+	s.aggregator.add(sample)
+}
+
+// merge accumulates an aggregate into the cumulative state of its series, returning an error if it is the first
+// time a collision with another series has been detected for it, after which it will be dropped.
+func (s *pushgatewayService) merge(v *aggregate) error {
+	k := aggregateKey{key: v.Key, metricType: v.Type}
+	if _, ok := s.collisions[k]; ok {
+		s.stats.dropped(1)
+		return nil
+	}
+	series, ok := s.series[k]
+	if !ok {
+		var unit string
+		if v.Type == MetricTiming {
+			unit = "seconds"
+		}
+		name := PrometheusMetricName(v.Info.Bucket, v.Type, unit)
+		if name == "" {
+			return nil
+		}
+		key, _ := NewPrometheusBucketKeyFunc()(BucketInfo{Bucket: name, Tags: v.Info.Tags})
+		series = &pushgatewaySeries{
+			name:   name,
+			labels: strings.TrimSuffix(strings.TrimPrefix(key[len(name):], "{"), "}"),
+		}
+		if metadata, ok := s.config.Metadata.Lookup(v.Info.Bucket); ok {
+			series.help = metadata.Description
+		}
+		switch v.Type {
+		case MetricCount:
+			series.kind = "counter"
+		case MetricGauge, MetricUnique:
+			series.kind = "gauge"
+		default:
+			series.kind = "histogram"
+			series.buckets = make([]uint64, len(s.config.Buckets))
+		}
+		identity := name + "{" + series.labels + "}"
+		samples := []string{name}
+		if series.kind == "histogram" {
+			samples = append(samples, name+"_bucket", name+"_sum", name+"_count")
+			if pushgatewayReservedLabel(v.Info, name, "le") {
+				s.collisions[k] = struct{}{}
+				s.stats.dropped(1)
+				return fmt.Errorf("appstats.pushgatewayService.Flush %s histogram uses the reserved le label", identity)
+			}
+		}
+		if kind, ok := s.families[name]; ok && kind != series.kind {
+			s.collisions[k] = struct{}{}
+			s.stats.dropped(1)
+			return fmt.Errorf("appstats.pushgatewayService.Flush %s %s collides with a %s", identity, series.kind, kind)
+		}
+		for _, sample := range samples {
+			if family, ok := s.samples[sample]; ok && family != name {
+				s.collisions[k] = struct{}{}
+				s.stats.dropped(1)
+				return fmt.Errorf("appstats.pushgatewayService.Flush %s %s collides with a %s", identity, series.kind, s.families[family])
+			}
+		}
+		if _, ok := s.identities[identity]; ok {
+			s.collisions[k] = struct{}{}
+			s.stats.dropped(1)
+			return fmt.Errorf("appstats.pushgatewayService.Flush %s %s collides with another series", identity, series.kind)
+		}
+		s.families[name] = series.kind
+		for _, sample := range samples {
+			s.samples[sample] = name
+		}
+		s.identities[identity] = struct{}{}
+		s.series[k] = series
+	}
+
+	switch v.Type {
+	case MetricCount:
+		series.value += v.Sum
+	case MetricGauge:
+		series.value = v.Last
+	case MetricUnique:
+		if series.uniques == nil {
+			series.uniques = make(map[string]struct{}, len(v.Uniques))
+		}
+		for unique := range v.Uniques {
+			series.uniques[unique] = struct{}{}
+		}
+		series.value = float64(len(series.uniques))
+	default:
+		for _, value := range v.Values {
+			if v.Type == MetricTiming {
+				value /= 1000
+			}
+			series.count++
+			series.sum += value
+			for i, bound := range s.config.Buckets {
+				if value <= bound {
+					series.buckets[i]++
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// pushgatewayReservedLabel returns true if the labels generated for info include label.
+func pushgatewayReservedLabel(info BucketInfo, name string, label string) bool {
+	tags := make(map[string][]string)
+	for key, values := range info.Tags {
+		if SanitisePrometheusLabel(key) == label {
+			tags[key] = values
+		}
+	}
+	if len(tags) == 0 {
+		return false
+	}
+	key, _ := NewPrometheusBucketKeyFunc()(BucketInfo{Bucket: name, Tags: tags})
+	return key != name
+}
+
+// render encodes every series in the text exposition format, grouped by family, sorted by name then labels.
+func (s *pushgatewayService) render() []byte {
+	series := make([]*pushgatewaySeries, 0, len(s.series))
+	for _, v := range s.series {
+		series = append(series, v)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	var (
+		b    bytes.Buffer
+		last *pushgatewaySeries
+	)
+
+	for _, v := range series {
+		if last == nil || last.name != v.name {
+			if v.help != "" {
+				fmt.Fprintf(&b, "# HELP %s %s\n", v.name, pushgatewayHelpReplacer.Replace(v.help))
+			}
+			fmt.Fprintf(&b, "# TYPE %s %s\n", v.name, v.kind)
+		}
+		last = v
+
+		if v.kind != "histogram" {
+			writePushgatewaySample(&b, v.name, v.labels, "", v.value)
+			continue
+		}
+
+		for i, bound := range s.config.Buckets {
+			writePushgatewaySample(&b, v.name+"_bucket", v.labels, formatPrometheusFloat(bound), float64(v.buckets[i]))
+		}
+		writePushgatewaySample(&b, v.name+"_bucket", v.labels, "+Inf", float64(v.count))
+		writePushgatewaySample(&b, v.name+"_sum", v.labels, "", v.sum)
+		writePushgatewaySample(&b, v.name+"_count", v.labels, "", float64(v.count))
+	}
+
+	return b.Bytes()
+}
+
+// pushgatewayHelpReplacer escapes backslashes and newlines, as required for HELP lines.
+var pushgatewayHelpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func writePushgatewaySample(b *bytes.Buffer, name, labels, le string, value float64) {
+	b.WriteString(name)
+	if labels != "" || le != "" {
+		b.WriteByte('{')
+		b.WriteString(labels)
+		if le != "" {
+			if labels != "" {
+				b.WriteByte(',')
+			}
+			b.WriteString(`le="`)
+			b.WriteString(le)
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatPrometheusFloat(value))
+	b.WriteByte('\n')
+}
+
+func formatPrometheusFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
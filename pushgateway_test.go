@@ -0,0 +1,419 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestPushgatewayURL(t *testing.T) {
+	testCases := []struct {
+		Base     string
+		Job      string
+		Grouping map[string]string
+		URL      string
+	}{
+		{
+			Base: "http://localhost:9091",
+			Job:  "batch",
+			URL:  "http://localhost:9091/metrics/job/batch",
+		},
+		{
+			Base: "http://localhost:9091/",
+			Job:  "some/job",
+			Grouping: map[string]string{
+				"instance": "host 1",
+				"empty":    "",
+				"path":     "/var/tmp",
+			},
+			URL: "http://localhost:9091/metrics/job@base64/c29tZS9qb2I=/empty@base64/=/instance/host%201/path@base64/L3Zhci90bXA=",
+		},
+	}
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestPushgatewayURL_#%d", i+1)
+		if url := PushgatewayURL(testCase.Base, testCase.Job, testCase.Grouping); url != testCase.URL {
+			t.Error(name, "expected =", testCase.URL, "actual =", url)
+		}
+	}
+}
+
+type pushgatewayTestRequest struct {
+	Method      string
+	Path        string
+	ContentType string
+	Body        string
+}
+
+func newPushgatewayTestServer(t *testing.T, status ...int) (*httptest.Server, func() []pushgatewayTestRequest) {
+	var (
+		mutex    sync.Mutex
+		requests []pushgatewayTestRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests, pushgatewayTestRequest{
+			Method:      r.Method,
+			Path:        r.URL.EscapedPath(),
+			ContentType: r.Header.Get("Content-Type"),
+			Body:        string(b),
+		})
+		if len(status) != 0 {
+			w.WriteHeader(status[0])
+			status = status[1:]
+		}
+	}))
+	return server, func() []pushgatewayTestRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		r := requests
+		requests = nil
+		return r
+	}
+}
+
+func TestPushgatewayService(t *testing.T) {
+	server, requests := newPushgatewayTestServer(t)
+	defer server.Close()
+
+	s := NewPushgatewayService(PushgatewayConfig{
+		URL:      server.URL,
+		Job:      "batch",
+		Grouping: map[string]string{"instance": "a"},
+		Client:   server.Client(),
+		Buckets:  []float64{0.1, 1},
+	})
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if r := requests(); len(r) != 0 {
+		t.Error("unexpected requests", r)
+	}
+
+	s.Bucket("http.requests").Tag("status", "200").Count(2)
+	s.Bucket("http.requests").Tag("status", "500").Increment()
+	s.Bucket("queue").Gauge(4)
+	s.Bucket("users").Unique("a")
+	s.Bucket("request.duration").Tag("path", `/a"b`).Timing(time.Millisecond * 50)
+	s.Bucket("request.duration").Tag("path", `/a"b`).Timing(time.Millisecond * 500)
+	s.Bucket("size").Histogram(2)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	const middle = `# TYPE queue gauge
+queue 4
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{path="/a\"b",le="0.1"} 1
+request_duration_seconds_bucket{path="/a\"b",le="1"} 2
+request_duration_seconds_bucket{path="/a\"b",le="+Inf"} 2
+request_duration_seconds_sum{path="/a\"b"} 0.55
+request_duration_seconds_count{path="/a\"b"} 2
+# TYPE size histogram
+size_bucket{le="0.1"} 0
+size_bucket{le="1"} 0
+size_bucket{le="+Inf"} 1
+size_sum 2
+size_count 1
+# TYPE users gauge
+`
+
+	if diff := deep.Equal(
+		requests(),
+		[]pushgatewayTestRequest{
+			{
+				Method:      http.MethodPut,
+				Path:        "/metrics/job/batch/instance/a",
+				ContentType: "text/plain; version=0.0.4",
+				Body: `# TYPE http_requests_total counter
+http_requests_total{status="200"} 2
+http_requests_total{status="500"} 1
+` + middle + `users 1
+`,
+			},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	// metrics are cumulative
+	s.Bucket("http.requests").Tag("status", "200").Increment()
+	s.Bucket("users").Unique("b")
+	s.Bucket("users").Unique("a")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := requests()
+	if len(r) != 1 {
+		t.Fatal("unexpected requests", r)
+	}
+	if diff := deep.Equal(
+		r[0].Body,
+		`# TYPE http_requests_total counter
+http_requests_total{status="200"} 3
+http_requests_total{status="500"} 1
+`+middle+`users 2
+`,
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPushgatewayService_metadata(t *testing.T) {
+	server, requests := newPushgatewayTestServer(t)
+	defer server.Close()
+
+	s := NewPushgatewayService(PushgatewayConfig{
+		URL:    server.URL,
+		Client: server.Client(),
+		Metadata: NewMetadataRegistry(
+			MetricMetadata{Name: "http.requests", Description: "The number of requests, by \\status\ncode."},
+			MetricMetadata{Name: "queue", Unit: "1"},
+		),
+	})
+
+	s.Bucket("http.requests").Tag("status", "200").Increment()
+	s.Bucket("http.requests").Tag("status", "500").Increment()
+	s.Bucket("queue").Gauge(4)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := requests()
+	if len(r) != 1 {
+		t.Fatal("unexpected requests", r)
+	}
+	if diff := deep.Equal(
+		r[0].Body,
+		`# HELP http_requests_total The number of requests, by \\status\ncode.
+# TYPE http_requests_total counter
+http_requests_total{status="200"} 1
+http_requests_total{status="500"} 1
+# TYPE queue gauge
+queue 4
+`,
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPushgatewayService_post(t *testing.T) {
+	server, requests := newPushgatewayTestServer(t, http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest)
+	defer server.Close()
+
+	s := NewPushgatewayService(PushgatewayConfig{
+		URL:          server.URL,
+		Method:       http.MethodPost,
+		Client:       server.Client(),
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	})
+
+	s.Bucket("a").Gauge(1)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		requests(),
+		[]pushgatewayTestRequest{
+			{Method: http.MethodPost, Path: "/metrics/job/appstats", ContentType: "text/plain; version=0.0.4", Body: "# TYPE a gauge\na 1\n"},
+			{Method: http.MethodPost, Path: "/metrics/job/appstats", ContentType: "text/plain; version=0.0.4", Body: "# TYPE a gauge\na 1\n"},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := s.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestPushgatewayService_collisions(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	server, requests := newPushgatewayTestServer(t)
+	defer server.Close()
+
+	stats, samples := newTestStatsBucket()
+
+	s := NewPushgatewayService(PushgatewayConfig{
+		URL:     server.URL,
+		Client:  server.Client(),
+		Buckets: []float64{1},
+		Stats:   stats,
+	})
+
+	s.Bucket("x").Tag("a.b", "1").Gauge(1)
+	s.Bucket("x").Tag("a_b", "1").Gauge(2)
+
+	if err := s.Flush(); err == nil || err.Error() != `appstats.pushgatewayService.Flush x{a_b="1"} gauge collides with another series` {
+		t.Error(err)
+	}
+
+	s.Bucket("x").Tag("a_b", "1").Gauge(3)
+	s.Bucket("x").Tag("a.b", "1").Histogram(0.5)
+	s.Bucket("x").Tag("a.b", "1").Gauge(4)
+
+	if err := s.Flush(); err == nil || err.Error() != `appstats.pushgatewayService.Flush x{a_b="1"} histogram collides with a gauge` {
+		t.Error(err)
+	}
+
+	// reported only once
+	s.Bucket("x").Tag("a.b", "1").Histogram(0.5)
+
+	if err := s.Flush(); err != nil {
+		t.Error(err)
+	}
+
+	var bodies []string
+	for _, r := range requests() {
+		bodies = append(bodies, r.Body)
+	}
+	if diff := deep.Equal(
+		bodies,
+		[]string{
+			"# TYPE x gauge\nx{a_b=\"1\"} 1\n",
+			"# TYPE x gauge\nx{a_b=\"1\"} 4\n",
+			"# TYPE x gauge\nx{a_b=\"1\"} 4\n",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 28",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=drops count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 28",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=drops count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 28",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPushgatewayService_reservedNames(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	server, requests := newPushgatewayTestServer(t)
+	defer server.Close()
+
+	stats, samples := newTestStatsBucket()
+
+	s := NewPushgatewayService(PushgatewayConfig{
+		URL:     server.URL,
+		Client:  server.Client(),
+		Buckets: []float64{1},
+		Stats:   stats,
+	})
+
+	s.Bucket("x").Histogram(0.5)
+	s.Bucket("x_count").Gauge(1)
+	s.Bucket("y_sum").Gauge(2)
+
+	if err := s.Flush(); err == nil || err.Error() != `appstats.pushgatewayService.Flush x_count{} gauge collides with a histogram` {
+		t.Error(err)
+	}
+
+	s.Bucket("y").Histogram(0.5)
+
+	if err := s.Flush(); err == nil || err.Error() != `appstats.pushgatewayService.Flush y{} histogram collides with a gauge` {
+		t.Error(err)
+	}
+
+	s.Bucket("z").Tag("le", "1").Histogram(0.5)
+
+	if err := s.Flush(); err == nil || err.Error() != `appstats.pushgatewayService.Flush z{le="1"} histogram uses the reserved le label` {
+		t.Error(err)
+	}
+
+	var bodies []string
+	for _, r := range requests() {
+		bodies = append(bodies, r.Body)
+	}
+	if diff := deep.Equal(
+		bodies,
+		[]string{
+			"# TYPE x histogram\nx_bucket{le=\"1\"} 1\nx_bucket{le=\"+Inf\"} 1\nx_sum 0.5\nx_count 1\n# TYPE y_sum gauge\ny_sum 2\n",
+			"# TYPE x histogram\nx_bucket{le=\"1\"} 1\nx_bucket{le=\"+Inf\"} 1\nx_sum 0.5\nx_count 1\n# TYPE y_sum gauge\ny_sum 2\n",
+			"# TYPE x histogram\nx_bucket{le=\"1\"} 1\nx_bucket{le=\"+Inf\"} 1\nx_sum 0.5\nx_count 1\n# TYPE y_sum gauge\ny_sum 2\n",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=lines count 2",
+			"stats,stat=bytes count 107",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=lines count 2",
+			"stats,stat=bytes count 107",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=drops count 1",
+			"stats,stat=errors count 1",
+			"stats,stat=lines count 2",
+			"stats,stat=bytes count 107",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
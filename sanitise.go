@@ -0,0 +1,206 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type (
+	// Sanitiser transforms a value into a form that is safe to use as (part of) a bucket key, and may be passed to
+	// NewBucketKeyFunc, see also NewSanitiser and SanitiseKey.
+	Sanitiser func(value string) string
+
+	// SanitiserOption configures a Sanitiser built using NewSanitiser.
+	SanitiserOption func(c *sanitiserConfig)
+
+	// RuneClass reports if a rune is a member of some set of runes, e.g. unicode.IsLetter.
+	RuneClass func(r rune) bool
+
+	sanitiserConfig struct {
+		maxLength   int
+		caseFold    func(r rune) rune
+		leading     RuneClass
+		allowed     RuneClass
+		replacement rune
+		collapse    bool
+		trimRight   RuneClass
+	}
+)
+
+var (
+	datadogAllowed = AnyRuneClass(unicode.IsLetter, unicode.IsNumber, RuneClassOf(`_-:./\`))
+
+	datadogSanitiser = NewSanitiser(
+		SanitiserMaxLength(200),
+		SanitiserCaseFold(unicode.ToLower),
+		SanitiserLeading(unicode.IsLetter),
+		SanitiserAllowed(datadogAllowed),
+		SanitiserReplacement('_'),
+		SanitiserTrimRight(RuneClassOf(":")),
+	)
+
+	datadogTagValueSanitiser = NewSanitiser(
+		SanitiserMaxLength(200),
+		SanitiserCaseFold(unicode.ToLower),
+		SanitiserAllowed(datadogAllowed),
+		SanitiserReplacement('_'),
+		SanitiserTrimRight(RuneClassOf(":")),
+	)
+)
+
+// NewSanitiser builds a configurable Sanitiser, which by default will replace nothing, so SanitiserAllowed should
+// almost always be provided, note that SanitiseKey is implemented using this function.
+// Each rune will first be case folded, then dropped if nothing has been written yet and it doesn't match the
+// leading class, written if it matches the allowed class, or otherwise replaced. Finally, the result will be
+// truncated to the max length, and any trailing runes in the trim class will be removed.
+func NewSanitiser(opts ...SanitiserOption) Sanitiser {
+	c := sanitiserConfig{
+		replacement: '_',
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&c)
+		}
+	}
+
+	return func(value string) string {
+		var (
+			b        strings.Builder
+			replaced bool
+		)
+
+		for _, r := range value {
+			if c.maxLength > 0 && b.Len() >= c.maxLength {
+				break
+			}
+
+			if c.caseFold != nil {
+				r = c.caseFold(r)
+			}
+
+			if b.Len() == 0 && c.leading != nil {
+				if c.leading(r) {
+					b.WriteRune(r)
+				}
+				continue
+			}
+
+			if c.allowed == nil || c.allowed(r) {
+				b.WriteRune(r)
+				replaced = false
+				continue
+			}
+
+			if c.replacement < 0 || (c.collapse && replaced) {
+				continue
+			}
+
+			b.WriteRune(c.replacement)
+			replaced = true
+		}
+
+		s := b.String()
+
+		for len(s) > 0 {
+			r, size := utf8.DecodeLastRuneInString(s)
+			if (c.maxLength <= 0 || len(s) <= c.maxLength) && (c.trimRight == nil || !c.trimRight(r)) {
+				break
+			}
+			s = s[:len(s)-size]
+		}
+
+		return s
+	}
+}
+
+// SanitiserMaxLength limits the length of the output, in bytes, to n, truncating on rune boundaries, note that
+// values <= 0 will disable the limit, which is the default.
+func SanitiserMaxLength(n int) SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.maxLength = n
+	}
+}
+
+// SanitiserCaseFold maps every rune prior to any other checks, e.g. unicode.ToLower, nil disables case folding,
+// which is the default.
+func SanitiserCaseFold(fold func(r rune) rune) SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.caseFold = fold
+	}
+}
+
+// SanitiserLeading configures the runes that may start the output, any runes prior to the first match will be
+// dropped, nil disables this behavior, treating the first rune like any other, which is the default.
+func SanitiserLeading(class RuneClass) SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.leading = class
+	}
+}
+
+// SanitiserAllowed configures the runes that will be written as-is, any others being replaced, nil allows every
+// rune, which is the default.
+func SanitiserAllowed(class RuneClass) SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.allowed = class
+	}
+}
+
+// SanitiserReplacement configures the rune written in place of any runes that are not allowed, a negative value
+// will drop them instead, the default is '_'.
+func SanitiserReplacement(r rune) SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.replacement = r
+	}
+}
+
+// SanitiserCollapse will cause consecutive runes that are not allowed to be replaced with a single replacement.
+func SanitiserCollapse() SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.collapse = true
+	}
+}
+
+// SanitiserTrimRight configures runes that will be trimmed from the end of the output, nil disables this behavior,
+// which is the default.
+func SanitiserTrimRight(class RuneClass) SanitiserOption {
+	return func(c *sanitiserConfig) {
+		c.trimRight = class
+	}
+}
+
+// RuneClassOf returns a RuneClass matching any of the runes in s.
+func RuneClassOf(s string) RuneClass {
+	return func(r rune) bool {
+		return strings.ContainsRune(s, r)
+	}
+}
+
+// AnyRuneClass returns a RuneClass matching any rune that matches at least one of classes.
+func AnyRuneClass(classes ...RuneClass) RuneClass {
+	return func(r rune) bool {
+		for _, class := range classes {
+			if class != nil && class(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"testing"
+	"unicode"
+)
+
+func TestNewSanitiser(t *testing.T) {
+	testCases := []struct {
+		Opts   []SanitiserOption
+		Input  string
+		Output string
+	}{
+		{
+			Input:  " Any\tThing, ñ!",
+			Output: " Any\tThing, ñ!",
+		},
+		{
+			Opts:   []SanitiserOption{nil, SanitiserCaseFold(unicode.ToUpper)},
+			Input:  "abc_Ñ",
+			Output: "ABC_Ñ",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserAllowed(unicode.IsLetter)},
+			Input:  "1 a!!b  c",
+			Output: "__a__b__c",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserAllowed(unicode.IsLetter), SanitiserCollapse()},
+			Input:  "1 a!!b  c",
+			Output: "_a_b_c",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserAllowed(unicode.IsLetter), SanitiserReplacement(-1)},
+			Input:  "1 a!!b  c",
+			Output: "abc",
+		},
+		{
+			Opts: []SanitiserOption{
+				SanitiserAllowed(unicode.IsLetter),
+				SanitiserLeading(unicode.IsLetter),
+				SanitiserReplacement('.'),
+				SanitiserCollapse(),
+				SanitiserTrimRight(RuneClassOf(".")),
+			},
+			Input:  "1 a!!b  c !!",
+			Output: "a.b.c",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserMaxLength(3)},
+			Input:  "abcdef",
+			Output: "abc",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserMaxLength(3)},
+			Input:  "abñ",
+			Output: "ab",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserMaxLength(3), SanitiserTrimRight(unicode.IsNumber)},
+			Input:  "a12b",
+			Output: "a",
+		},
+		{
+			Opts:   []SanitiserOption{SanitiserMaxLength(0), SanitiserTrimRight(AnyRuneClass(nil, unicode.IsSpace))},
+			Input:  "   ",
+			Output: "",
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewSanitiser_#%d", i+1)
+
+		output := NewSanitiser(testCase.Opts...)(testCase.Input)
+
+		if output != testCase.Output {
+			t.Error(name, "output", "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
+
+func TestNewSanitiser_bucketKeyFunc(t *testing.T) {
+	keyFunc := NewBucketKeyFunc(NewSanitiser(
+		SanitiserAllowed(AnyRuneClass(unicode.IsLetter, unicode.IsNumber)),
+		SanitiserCollapse(),
+	))
+	if key, ok := keyFunc(BucketInfo{Bucket: "a.b/c", Tags: map[string][]string{"status code": {"200"}}}); key != "a_b_c,status_code=200" || !ok {
+		t.Error(key, ok)
+	}
+}
+
+func TestSanitiseTagValue(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output string
+	}{
+		{
+			Input:  "",
+			Output: "",
+		},
+		{
+			Input:  "200",
+			Output: "200",
+		},
+		{
+			Input:  " US-East-1 ",
+			Output: "_us-east-1_",
+		},
+		{
+			Input:  "::a::",
+			Output: "::a",
+		},
+		{
+			Input:  ":::",
+			Output: "",
+		},
+	}
+
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestSanitiseTagValue_#%d", i+1)
+
+		output := SanitiseTagValue(testCase.Input)
+
+		if output != testCase.Output {
+			t.Error(name, "output", "expected =", testCase.Output, "actual =", output)
+		}
+	}
+}
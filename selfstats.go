@@ -0,0 +1,112 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"time"
+)
+
+// StatTag is the tag key used to distinguish the metrics sent to the Stats bucket of each config, e.g.
+// CarbonConfig.Stats, which report the health of the pipeline itself, where the value is one of the Stat constants.
+const StatTag = "stat"
+
+const (
+	// StatLines is a count of the lines (or datapoints, series, documents, records) sent.
+	StatLines = "lines"
+	// StatBytes is a count of the bytes sent.
+	StatBytes = "bytes"
+	// StatPackets is a count of the packets (or writes, requests) sent.
+	StatPackets = "packets"
+	// StatDrops is a count of the lines (or datapoints, records) dropped, e.g. due to a full buffer, note that
+	// lines that fail to send, and are retried, are not counted.
+	StatDrops = "drops"
+	// StatErrors is a count of the errors, including those passed to ErrorHandler, or returned by Flush.
+	StatErrors = "errors"
+	// StatQueueDepth is a gauge of the amount of data pending, after each flush, where the unit depends on the
+	// implementation.
+	StatQueueDepth = "queue_depth"
+	// StatFlushLatency is a timing of each flush, including any retries.
+	StatFlushLatency = "flush_latency"
+)
+
+type (
+	// selfStats reports the health of the pipeline to a Bucket, and is nil (a no-op) if there is no Bucket, note that
+	// the methods must not be called while holding a lock, as the Bucket may (indirectly) send to the same Service.
+	selfStats struct {
+		lines, bytes, packets, drops, errors, queueDepth, flushLatency Bucket
+	}
+)
+
+// newSelfStats returns nil if bucket is nil.
+func newSelfStats(bucket Bucket) *selfStats {
+	if bucket == nil {
+		return nil
+	}
+	return &selfStats{
+		lines:        bucket.Tag(StatTag, StatLines),
+		bytes:        bucket.Tag(StatTag, StatBytes),
+		packets:      bucket.Tag(StatTag, StatPackets),
+		drops:        bucket.Tag(StatTag, StatDrops),
+		errors:       bucket.Tag(StatTag, StatErrors),
+		queueDepth:   bucket.Tag(StatTag, StatQueueDepth),
+		flushLatency: bucket.Tag(StatTag, StatFlushLatency),
+	}
+}
+
+// sent records a single packet, containing the given number of lines and bytes.
+func (s *selfStats) sent(lines, bytes int) {
+	if s == nil {
+		return
+	}
+	if lines != 0 {
+		s.lines.Count(lines)
+	}
+	s.bytes.Count(bytes)
+	s.packets.Increment()
+}
+
+func (s *selfStats) dropped(lines int) {
+	if s == nil || lines == 0 {
+		return
+	}
+	s.drops.Count(lines)
+}
+
+func (s *selfStats) error() {
+	if s == nil {
+		return
+	}
+	s.errors.Increment()
+}
+
+// queue records the current queue depth, note that depth will only be called if there is a Bucket, and so it may
+// acquire a lock, e.g. `defer s.stats.queue(s.queued)`.
+func (s *selfStats) queue(depth func() int) {
+	if s == nil {
+		return
+	}
+	s.queueDepth.Gauge(depth())
+}
+
+// flushed records the latency of a flush, that started at start.
+func (s *selfStats) flushed(start time.Time) {
+	if s == nil {
+		return
+	}
+	s.flushLatency.Timing(timeNow().Sub(start))
+}
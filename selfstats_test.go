@@ -0,0 +1,95 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// newTestStatsBucket returns a Bucket that records every sample, like "stats,stat=lines count 2", and a func that
+// returns (and resets) the recorded samples.
+func newTestStatsBucket() (Bucket, func() []string) {
+	var (
+		mutex   sync.Mutex
+		samples []string
+	)
+	bucket := NewBucket("stats", canonicalBucketKey, func(sample Sample) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		samples = append(samples, fmt.Sprintf("%s %s %v", sample.Key, sample.Type, sample.Value))
+	})
+	return bucket, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		r := samples
+		samples = nil
+		return r
+	}
+}
+
+func TestSelfStats(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	var stats *selfStats = newSelfStats(nil)
+	if stats != nil {
+		t.Fatal(stats)
+	}
+
+	// a nil value is a no-op
+	stats.sent(1, 2)
+	stats.dropped(1)
+	stats.error()
+	stats.queue(func() int {
+		t.Error("unexpected call")
+		return 0
+	})
+	stats.flushed(timeNow())
+
+	bucket, samples := newTestStatsBucket()
+	stats = newSelfStats(bucket)
+
+	stats.sent(2, 10)
+	stats.sent(0, 5)
+	stats.dropped(0)
+	stats.dropped(3)
+	stats.error()
+	stats.queue(func() int { return 7 })
+	stats.flushed(time.Unix(99, 0))
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=lines count 2",
+			"stats,stat=bytes count 10",
+			"stats,stat=packets count 1",
+			"stats,stat=bytes count 5",
+			"stats,stat=packets count 1",
+			"stats,stat=drops count 3",
+			"stats,stat=errors count 1",
+			"stats,stat=queue_depth gauge 7",
+			"stats,stat=flush_latency timing 1s",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,558 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolSegmentExt is the file extension of spool segments, which are named by a zero padded sequence number.
+const spoolSegmentExt = ".wal"
+
+type (
+	// TimestampService is an optional interface, implemented by Service implementations that support sending
+	// metrics with an explicit timestamp, e.g. NewCarbonService and NewOpenTSDBService, which is used by
+	// NewSpoolService, to replay metrics at the time they were originally sent.
+	TimestampService interface {
+		Service
+		// BucketAt is equivalent to Bucket, except that metrics sent using the returned Bucket (or any derived
+		// buckets) will be timestamped with the given time, where supported, e.g. counts may still be aggregated.
+		BucketAt(bucket interface{}, timestamp time.Time) Bucket
+	}
+
+	// spoolDiscarder is implemented by services that retain data that failed to send, to retry it themselves, e.g.
+	// NewCarbonService, allowing NewSpoolService to discard it instead, as it will be replayed.
+	spoolDiscarder interface {
+		discard()
+	}
+
+	// SpoolConfig configures a Service created by NewSpoolService, note that only Service and Dir are required.
+	SpoolConfig struct {
+		// Service is the wrapped service, which the spooled metrics will be replayed to.
+		Service Service
+		// Dir is the directory the write-ahead log segments will be stored in, which will be created if necessary,
+		// and should not be shared, note that any existing segments will be replayed.
+		Dir string
+		// MaxSegmentSize is the max size of each segment, in bytes, it defaults to 4 MiB, note that any record that
+		// is larger will be dropped.
+		MaxSegmentSize int64
+		// MaxSize is the max total size of all segments, in bytes, after which the oldest segments will be dropped,
+		// it defaults to 64 MiB.
+		MaxSize int64
+		// MaxAge is the max age of any spooled metric, older metrics (and segments) will be dropped, it defaults to
+		// 24 hours.
+		MaxAge time.Duration
+		// Interval is how frequently spooled metrics will be replayed, it defaults to 10 seconds, and a negative
+		// value disables flushing in the background.
+		Interval time.Duration
+		// ReplayBatchSize is the max number of records replayed before the wrapped Service is flushed, it defaults
+		// to 1000, and must be less than the number of metrics the wrapped Service will buffer, e.g.
+		// CarbonConfig.MaxPending, or they will be dropped.
+		ReplayBatchSize int
+		// Stats is an optional Bucket, which will be sent metrics about this service, distinguished by StatTag,
+		// where StatLines counts records replayed, StatPackets counts segments replayed, StatDrops counts records
+		// dropped due to the limits, and StatQueueDepth is the total size of all segments, in bytes.
+		Stats Bucket
+		// ErrorHandler will be called with any errors writing to the spool, or flushing in the background, if it
+		// is set.
+		ErrorHandler func(err error)
+	}
+
+	spoolService struct {
+		config     SpoolConfig
+		stats      *selfStats
+		timestamps TimestampService
+		mutex      sync.Mutex
+		file       *os.File
+		writer     *bufio.Writer
+		current    *spoolSegment
+		segments   []*spoolSegment
+		size       int64
+		sequence   uint64
+		flushMutex sync.Mutex
+		closeOnce  sync.Once
+		stop       chan struct{}
+		done       chan struct{}
+	}
+
+	spoolSegment struct {
+		path     string
+		size     int64
+		records  int
+		modified time.Time
+		// replayed is the number of lines that have been replayed, and flushed successfully.
+		replayed int
+	}
+
+	// spoolRecord is a single line of a segment, where Key is the canonical text encoding of the BucketInfo, Time is
+	// in unix nanoseconds, Type is the numeric MetricType, and Value is formatted using `%v`, except for timings,
+	// which are in nanoseconds.
+	spoolRecord struct {
+		Time  int64  `json:"t"`
+		Key   string `json:"k"`
+		Type  int    `json:"m"`
+		Value string `json:"v"`
+	}
+)
+
+// NewSpoolService wraps a Service, writing every metric to a bounded, on-disk, write-ahead log, which is replayed to
+// the wrapped Service, in order, on each Flush (and Close), in batches of ReplayBatchSize records, each followed by a
+// Flush of the wrapped Service, and each segment is deleted only once all of its records have been flushed
+// successfully, meaning that metrics sent during an outage are delivered once connectivity returns, or after a
+// restart, rather than being lost. If the wrapped Service implements TimestampService, metrics will be replayed with
+// the time they were originally sent.
+//
+// Delivery is at-least-once, as a batch will be replayed again if the wrapped Service fails to flush, as will any
+// partially replayed segment, after a restart, so it is best suited to services that drop data on failure (e.g.
+// NewDatadogService). Services that would otherwise retry the failed batch themselves, NewCarbonService and
+// NewOpenTSDBService, have it discarded, so it is delivered only by the replay, which would otherwise double any
+// counts, as they are timestamped with the time of the flush. The wrapped Service should not flush in the
+// background. Note that it will panic if Service is nil, or Dir is empty, and that any error reading Dir will be
+// passed to ErrorHandler.
+func NewSpoolService(config SpoolConfig) Service {
+	if config.Service == nil {
+		panic(errors.New("appstats.NewSpoolService nil service"))
+	}
+	if config.Dir == "" {
+		panic(errors.New("appstats.NewSpoolService empty dir"))
+	}
+	if config.MaxSegmentSize <= 0 {
+		config.MaxSegmentSize = 4 << 20
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 64 << 20
+	}
+	if config.MaxSize < config.MaxSegmentSize {
+		config.MaxSize = config.MaxSegmentSize
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = time.Hour * 24
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second * 10
+	}
+	if config.ReplayBatchSize <= 0 {
+		config.ReplayBatchSize = 1000
+	}
+
+	s := &spoolService{
+		config: config,
+		stats:  newSelfStats(config.Stats),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.timestamps, _ = config.Service.(TimestampService)
+
+	if err := s.load(); err != nil {
+		s.stats.error()
+		s.handleError(fmt.Errorf("appstats.NewSpoolService load error: %s", err.Error()))
+	}
+
+	if config.Interval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s
+}
+
+// Bucket returns a new bucket, which writes to the spool.
+func (s *spoolService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, s.sample)
+}
+
+// Flush replays every segment to the wrapped Service, in order, stopping at the first error, note that the segment
+// currently being written is closed first, meaning any metrics sent concurrently will be written to a new segment.
+func (s *spoolService) Flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	defer s.stats.queue(s.queued)
+	defer s.stats.flushed(timeNow())
+
+	s.mutex.Lock()
+	err := s.rotateLocked()
+	segments := append([]*spoolSegment(nil), s.segments...)
+	s.mutex.Unlock()
+
+	if err != nil {
+		s.stats.error()
+		return fmt.Errorf("appstats.spoolService.Flush rotate error: %s", err.Error())
+	}
+
+	for _, segment := range segments {
+		if err := s.replay(segment); err != nil {
+			s.stats.error()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close stops flushing in the background, then flushes, and closes the wrapped Service, note that any segments
+// that could not be replayed will be kept, and replayed by the next NewSpoolService using the same Dir.
+func (s *spoolService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	err := s.Flush()
+	if closeErr := s.config.Service.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("appstats.spoolService.Close close error: %s", closeErr.Error())
+	}
+	return err
+}
+
+func (s *spoolService) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.handleError(err)
+			}
+		}
+	}
+}
+
+func (s *spoolService) sample(sample Sample) {
+	record := spoolRecord{
+		Time: timeNow().UnixNano(),
+		Key:  sample.Key,
+		Type: int(sample.Type),
+	}
+	if sample.Type == MetricTiming {
+		d, ok := TimingToDuration(sample.Value, time.Nanosecond)
+		if !ok {
+			return
+		}
+		record.Value = strconv.FormatInt(int64(d), 10)
+	} else {
+		record.Value = fmt.Sprint(sample.Value)
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		s.stats.error()
+		s.handleError(fmt.Errorf("appstats.spoolService encode error: %s", err.Error()))
+		return
+	}
+	b = append(b, '\n')
+
+	if int64(len(b)) > s.config.MaxSegmentSize {
+		// it would never fit in a segment, and could not be replayed
+		s.stats.error()
+		s.stats.dropped(1)
+		s.handleError(fmt.Errorf("appstats.spoolService record exceeds MaxSegmentSize: %d bytes", len(b)))
+		return
+	}
+
+	s.mutex.Lock()
+	dropped, err := s.writeLocked(b)
+	s.mutex.Unlock()
+
+	s.drop(dropped)
+
+	if err != nil {
+		s.stats.error()
+		s.handleError(fmt.Errorf("appstats.spoolService write error: %s", err.Error()))
+	}
+}
+
+// writeLocked appends a line to the current segment, opening a new segment if necessary, then enforces the limits,
+// returning any segments that must be dropped.
+func (s *spoolService) writeLocked(line []byte) ([]*spoolSegment, error) {
+	if s.current != nil && s.current.size+int64(len(line)) > s.config.MaxSegmentSize {
+		if err := s.rotateLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.current == nil {
+		s.sequence++
+		path := filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", s.sequence, spoolSegmentExt))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.file = file
+		s.writer = bufio.NewWriter(file)
+		s.current = &spoolSegment{path: path}
+	}
+
+	if _, err := s.writer.Write(line); err != nil {
+		return nil, err
+	}
+
+	s.current.size += int64(len(line))
+	s.current.records++
+	s.current.modified = timeNow()
+	s.size += int64(len(line))
+
+	return s.limitLocked(), nil
+}
+
+// rotateLocked closes the current segment, if any, making it available for replay.
+func (s *spoolService) rotateLocked() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.writer.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.segments = append(s.segments, s.current)
+	s.file = nil
+	s.writer = nil
+	s.current = nil
+	return err
+}
+
+// limitLocked removes the oldest segments, until the total size is within MaxSize, and any that are older than
+// MaxAge, returning them, to be deleted by drop, note that the current segment is never removed.
+func (s *spoolService) limitLocked() []*spoolSegment {
+	var dropped []*spoolSegment
+	expired := timeNow().Add(-s.config.MaxAge)
+	for len(s.segments) != 0 &&
+		(s.size > s.config.MaxSize || s.segments[0].modified.Before(expired)) {
+		dropped = append(dropped, s.segments[0])
+		s.removeLocked(s.segments[0])
+	}
+	return dropped
+}
+
+// removeLocked removes a segment, returning false if it has already been removed, note that the file is not
+// deleted, see delete.
+func (s *spoolService) removeLocked(segment *spoolSegment) bool {
+	for i, v := range s.segments {
+		if v == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= segment.size
+			return true
+		}
+	}
+	return false
+}
+
+// drop deletes segments that were removed by limitLocked.
+func (s *spoolService) drop(segments []*spoolSegment) {
+	var records int
+	for _, segment := range segments {
+		s.mutex.Lock()
+		records += segment.records - segment.replayed
+		s.mutex.Unlock()
+		s.delete(segment)
+	}
+	s.stats.dropped(records)
+}
+
+func (s *spoolService) delete(segment *spoolSegment) {
+	if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+		s.stats.error()
+		s.handleError(fmt.Errorf("appstats.spoolService remove error: %s", err.Error()))
+	}
+}
+
+// queued returns the total size of all segments, in bytes.
+func (s *spoolService) queued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(s.size)
+}
+
+// replay sends every record of a segment to the wrapped Service, flushing it after every ReplayBatchSize records,
+// and deleting the segment once every record has been flushed, note that records older than MaxAge, or that cannot
+// be decoded (e.g. a partial write), will be skipped, as will any that were replayed by a previous call.
+func (s *spoolService) replay(segment *spoolSegment) error {
+	file, err := os.Open(segment.path)
+	if os.IsNotExist(err) {
+		// dropped due to the limits, concurrently
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("appstats.spoolService.Flush open error: %s", err.Error())
+	}
+	defer file.Close()
+
+	expired := timeNow().Add(-s.config.MaxAge).UnixNano()
+
+	s.mutex.Lock()
+	replayed := segment.replayed
+	s.mutex.Unlock()
+
+	var lines, records, batch, dropped int
+	scanner := bufio.NewScanner(file)
+	// segments written with a larger MaxSegmentSize, e.g. prior to a restart, may contain longer lines
+	maxLine := s.config.MaxSegmentSize
+	if segment.size > maxLine {
+		maxLine = segment.size
+	}
+	scanner.Buffer(nil, int(maxLine)+1)
+	for scanner.Scan() {
+		lines++
+		if lines <= replayed {
+			continue
+		}
+		var (
+			record spoolRecord
+			info   BucketInfo
+		)
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || info.UnmarshalText([]byte(record.Key)) != nil {
+			continue
+		}
+		if record.Time < expired {
+			dropped++
+			continue
+		}
+		s.send(record, info)
+		records++
+		batch++
+		if batch >= s.config.ReplayBatchSize {
+			if err := s.flushReplayed(segment, lines); err != nil {
+				return err
+			}
+			s.stats.dropped(dropped)
+			batch, dropped = 0, 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("appstats.spoolService.Flush read error: %s", err.Error())
+	}
+
+	if err := s.flushReplayed(segment, lines); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	removed := s.removeLocked(segment)
+	s.mutex.Unlock()
+
+	if removed {
+		s.delete(segment)
+	}
+
+	s.stats.sent(records, int(segment.size))
+	s.stats.dropped(dropped)
+
+	return nil
+}
+
+// flushReplayed flushes the wrapped Service, recording that the first lines of segment have been replayed, if it
+// was successful.
+func (s *spoolService) flushReplayed(segment *spoolSegment, lines int) error {
+	if err := s.config.Service.Flush(); err != nil {
+		if discarder, ok := s.config.Service.(spoolDiscarder); ok {
+			discarder.discard()
+		}
+		return fmt.Errorf("appstats.spoolService.Flush flush error: %s", err.Error())
+	}
+	s.mutex.Lock()
+	segment.replayed = lines
+	s.mutex.Unlock()
+	return nil
+}
+
+// send sends a record to the wrapped Service, using BucketAt if it is supported.
+func (s *spoolService) send(record spoolRecord, info BucketInfo) {
+	var bucket Bucket
+	if s.timestamps != nil {
+		bucket = s.timestamps.BucketAt(info.Bucket, time.Unix(0, record.Time))
+	} else {
+		bucket = s.config.Service.Bucket(info.Bucket)
+	}
+	bucket = applyBucketTags(bucket, info)
+	switch MetricType(record.Type) {
+	case MetricCount:
+		bucket.Count(record.Value)
+	case MetricGauge:
+		bucket.Gauge(record.Value)
+	case MetricHistogram:
+		bucket.Histogram(record.Value)
+	case MetricUnique:
+		bucket.Unique(record.Value)
+	case MetricTiming:
+		if n, err := strconv.ParseInt(record.Value, 10, 64); err == nil {
+			bucket.Timing(time.Duration(n))
+		}
+	}
+}
+
+// load creates Dir, if necessary, and finds any existing segments, which will be replayed, oldest first.
+func (s *spoolService) load() error {
+	if err := os.MkdirAll(s.config.Dir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(s.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if sequence > s.sequence {
+			s.sequence = sequence
+		}
+		segment := &spoolSegment{
+			path:     filepath.Join(s.config.Dir, name),
+			size:     file.Size(),
+			modified: file.ModTime(),
+		}
+		if s.stats != nil {
+			// only necessary for StatDrops
+			if b, err := ioutil.ReadFile(segment.path); err == nil {
+				segment.records = bytes.Count(b, []byte{'\n'})
+			}
+		}
+		s.segments = append(s.segments, segment)
+		s.size += file.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].path < s.segments[j].path
+	})
+	s.drop(s.limitLocked())
+	return nil
+}
+
+func (s *spoolService) handleError(err error) {
+	if s.config.ErrorHandler != nil {
+		s.config.ErrorHandler(err)
+	}
+}
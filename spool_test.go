@@ -0,0 +1,529 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// mockSpoolService records every sample it receives, like a Service that drops data on a failed Flush.
+type mockSpoolService struct {
+	mutex   sync.Mutex
+	pending []string
+	flushed [][]string
+	errs    []error
+	closed  int
+}
+
+func (s *mockSpoolService) Bucket(bucket interface{}) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, func(sample Sample) {
+		s.add(fmt.Sprintf("%s %s %v", sample.Key, sample.Type, sample.Value))
+	})
+}
+
+func (s *mockSpoolService) BucketAt(bucket interface{}, timestamp time.Time) Bucket {
+	return NewBucket(bucket, canonicalBucketKey, func(sample Sample) {
+		s.add(fmt.Sprintf("%s %s %v @%d", sample.Key, sample.Type, sample.Value, timestamp.Unix()))
+	})
+}
+
+func (s *mockSpoolService) add(v string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = append(s.pending, v)
+}
+
+func (s *mockSpoolService) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := s.pending
+	s.pending = nil
+	if len(s.errs) != 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	s.flushed = append(s.flushed, pending)
+	return nil
+}
+
+func (s *mockSpoolService) Close() error {
+	s.closed++
+	return nil
+}
+
+// untimedSpoolService hides BucketAt.
+type untimedSpoolService struct {
+	Service
+}
+
+func spoolSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+func TestSpoolService(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := &mockSpoolService{errs: []error{errors.New("some_error")}}
+
+	s := NewSpoolService(SpoolConfig{
+		Service:        inner,
+		Dir:            filepath.Join(dir, "spool"),
+		MaxSegmentSize: 120,
+		Interval:       -1,
+	})
+
+	s.Bucket("a").Tag("k", "v", 1).Count(2)
+	s.Bucket("b").Gauge(1.5)
+	s.Bucket("c").Timing(time.Millisecond * 5)
+	stubTimeNow(time.Unix(101, 0))
+	s.Bucket("d").Unique("x y")
+	s.Bucket("e").Histogram("7")
+	s.Bucket("f").Tag("empty").Increment()
+
+	if diff := deep.Equal(
+		spoolSegments(t, filepath.Join(dir, "spool")),
+		[]string{
+			"00000000000000000001.wal",
+			"00000000000000000002.wal",
+			"00000000000000000003.wal",
+		},
+	); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// the first segment fails, and so nothing is removed
+	if err := s.Flush(); err == nil || err.Error() != "appstats.spoolService.Flush flush error: some_error" {
+		t.Fatal(err)
+	}
+	if len(spoolSegments(t, filepath.Join(dir, "spool"))) != 3 {
+		t.Error("unexpected segments")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		inner.flushed,
+		[][]string{
+			{"a,k=v,k=1 count 2 @100", "b gauge 1.5 @100"},
+			{"c timing 5ms @100", "d unique x y @101"},
+			{"e histogram 7 @101", "f,empty count 1 @101"},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+	if inner.closed != 1 {
+		t.Error(inner.closed)
+	}
+	if segments := spoolSegments(t, filepath.Join(dir, "spool")); len(segments) != 0 {
+		t.Error(segments)
+	}
+}
+
+func TestSpoolService_restart(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := &mockSpoolService{errs: []error{errors.New("some_error")}}
+
+	s := NewSpoolService(SpoolConfig{
+		Service:  untimedSpoolService{inner},
+		Dir:      dir,
+		Interval: -1,
+	})
+
+	s.Bucket("a").Increment()
+
+	if err := s.Close(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	s = NewSpoolService(SpoolConfig{
+		Service:  untimedSpoolService{inner},
+		Dir:      dir,
+		Interval: -1,
+	})
+
+	s.Bucket("b").Increment()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(inner.flushed, [][]string{{"a count 1"}, {"b count 1"}}); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(spoolSegments(t, dir), []string(nil)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSpoolService_limits(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a partial write, e.g. due to a crash, is skipped
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000007.wal"), []byte(`{"t":100000000000,"k":"z","m":1,"v":"1"}`+"\n"+`{"t":1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &mockSpoolService{}
+	stats, samples := newTestStatsBucket()
+
+	s := NewSpoolService(SpoolConfig{
+		Stats:          stats,
+		Service:        inner,
+		Dir:            dir,
+		MaxSegmentSize: 50,
+		MaxSize:        100,
+		MaxAge:         time.Minute,
+		Interval:       -1,
+	})
+
+	s.Bucket("a").Increment()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Bucket("b").Increment()
+	s.Bucket("c").Increment()
+
+	// drops the oldest segment
+	stubTimeNow(time.Unix(130, 0))
+	s.Bucket("d").Increment()
+
+	if diff := deep.Equal(
+		spoolSegments(t, dir),
+		[]string{
+			"00000000000000000010.wal",
+			"00000000000000000011.wal",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	// c expires
+	stubTimeNow(time.Unix(170, 0))
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		inner.flushed,
+		[][]string{
+			{"z count 1 @100"},
+			{"a count 1 @100"},
+			nil,
+			{"d count 1 @130"},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 47",
+			"stats,stat=packets count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 41",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+			// b was dropped by size
+			"stats,stat=drops count 1",
+			// c was dropped by age
+			"stats,stat=bytes count 41",
+			"stats,stat=packets count 1",
+			"stats,stat=drops count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 41",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSpoolService_oversized(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := &mockSpoolService{}
+	stats, samples := newTestStatsBucket()
+	var errs []string
+
+	s := NewSpoolService(SpoolConfig{
+		Stats:          stats,
+		Service:        inner,
+		Dir:            dir,
+		MaxSegmentSize: 50,
+		Interval:       -1,
+		ErrorHandler: func(err error) {
+			errs = append(errs, err.Error())
+		},
+	})
+
+	s.Bucket("some_bucket_with_a_name_that_is_far_too_long").Increment()
+	s.Bucket("a").Increment()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(inner.flushed, [][]string{{"a count 1 @100"}}); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(errs, []string{"appstats.spoolService record exceeds MaxSegmentSize: 84 bytes"}); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(spoolSegments(t, dir), []string(nil)); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=errors count 1",
+			"stats,stat=drops count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 41",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSpoolService_batches(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats, samples := newTestStatsBucket()
+
+	inner := &mockSpoolService{errs: []error{nil, errors.New("some_error")}}
+
+	s := NewSpoolService(SpoolConfig{
+		Stats:           stats,
+		Service:         inner,
+		Dir:             dir,
+		Interval:        -1,
+		ReplayBatchSize: 2,
+	})
+
+	for i := 0; i < 5; i++ {
+		s.Bucket("a").Gauge(i)
+	}
+
+	// the second batch fails
+	if err := s.Flush(); err == nil || err.Error() != "appstats.spoolService.Flush flush error: some_error" {
+		t.Fatal(err)
+	}
+
+	// only the failed batch, and the remainder, are replayed
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		inner.flushed,
+		[][]string{
+			{"a gauge 0 @100", "a gauge 1 @100"},
+			{"a gauge 2 @100", "a gauge 3 @100"},
+			{"a gauge 4 @100"},
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(spoolSegments(t, dir), []string(nil)); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=errors count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 205",
+			"stats,stat=lines count 3",
+			"stats,stat=bytes count 205",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSpoolService_carbon(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener := newTestListener(t)
+	defer listener.Close()
+
+	s := NewSpoolService(SpoolConfig{
+		Service: NewCarbonService(CarbonConfig{
+			Address:    listener.Addr().String(),
+			Interval:   -1,
+			MaxPending: 10,
+		}),
+		Dir:             dir,
+		Interval:        -1,
+		ReplayBatchSize: 8,
+	})
+
+	var expected []string
+	for i := 0; i < 25; i++ {
+		s.Bucket("a").Gauge(i)
+		expected = append(expected, fmt.Sprintf("a %d 100", i))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// more records than carbon's MaxPending, none of which were dropped
+	listener.expect(t, expected...)
+}
+
+func TestSpoolService_carbonRetry(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		dials   int
+		written bytes.Buffer
+		mutex   sync.Mutex
+	)
+
+	s := NewSpoolService(SpoolConfig{
+		Service: NewCarbonService(CarbonConfig{
+			Interval: -1,
+			Dial: func(network, address string) (net.Conn, error) {
+				dials++
+				if dials == 1 {
+					return nil, errors.New("some_error")
+				}
+				client, server := net.Pipe()
+				go func() {
+					mutex.Lock()
+					defer mutex.Unlock()
+					io.Copy(&written, server)
+				}()
+				return client, nil
+			},
+		}),
+		Dir:      dir,
+		Interval: -1,
+	})
+
+	s.Bucket("reqs").Count(5)
+	s.Bucket("a").Gauge(1)
+
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	stubTimeNow(time.Unix(101, 0))
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// the failed batch was discarded by carbon, so it was delivered only once
+	if s := written.String(); s != "a 1 100\nreqs 5 101\n" {
+		t.Error(s)
+	}
+}
@@ -30,7 +30,7 @@ type (
 
 	statsDBucket struct {
 		service statsDService
-		bucket  *BucketInfo
+		bucket  *bucketState
 	}
 
 	statsDClientStub struct{}
@@ -60,37 +60,59 @@ func (statsDClientStub) Timing(bucket string, value interface{}) {
 func (statsDClientStub) Unique(bucket string, value string) {
 }
 
-// Close calls statsd.Client.Close.
+// Close calls statsd.Client.Close, or StatsDErrorClient.CloseErr, if it is implemented.
 func (s statsDService) Close() error {
+	if client, ok := s.client.(StatsDErrorClient); ok {
+		return client.CloseErr()
+	}
 	s.client.Close()
 	return nil
 }
 
-// Flush calls statsd.Client.Flush.
+// Flush calls statsd.Client.Flush, or StatsDErrorClient.FlushErr, if it is implemented.
 func (s statsDService) Flush() error {
+	if client, ok := s.client.(StatsDErrorClient); ok {
+		return client.FlushErr()
+	}
 	s.client.Flush()
 	return nil
 }
 
+// Enabled returns false if the client is the stub used when NewStatsDService was called with a nil client.
+func (s statsDService) Enabled() bool {
+	switch s.client.(type) {
+	case nil, statsDClientStub:
+		return false
+	default:
+		return true
+	}
+}
+
 // Bucket returns a new bucket with no tags, string formatting the bucket value with `%v`.
 func (s statsDService) Bucket(b interface{}) Bucket {
 	return statsDBucket{
 		service: s,
-		bucket: &BucketInfo{
-			Bucket: fmt.Sprint(b),
-		},
+		bucket:  newBucketState(b),
 	}
 }
 
 // Tag returns a bucket with the tag and possibly values appended, string formatting all args with `%v`, note that
-// this WILL NOT modify the original bucket.
+// this WILL NOT modify the original bucket, and that the tags are shared with the original, rather than copied.
 func (b statsDBucket) Tag(key interface{}, values ...interface{}) Bucket {
+	if b.bucket == nil {
+		b.bucket = new(bucketState)
+	}
 	return statsDBucket{
 		service: b.service,
-		bucket:  b.bucket.Tag(key, values...),
+		bucket:  b.bucket.tag(key, values...),
 	}
 }
 
+// Enabled returns false if the service is not enabled, or the key func returns an empty key or !ok.
+func (b statsDBucket) Enabled() bool {
+	return b.service.Enabled() && b.bucketKey() != ""
+}
+
 // Count passes through directly to statsd.Client.Count.
 func (b statsDBucket) Count(n interface{}) {
 	if bucket := b.bucketKey(); bucket != "" {
@@ -149,7 +171,7 @@ func (b statsDBucket) bucketKey() string {
 	if b.bucket == nil {
 		return ""
 	}
-	v, ok := b.service.keyFunc(*b.bucket)
+	v, ok := b.bucket.bucketKey(b.service.keyFunc)
 	if !ok {
 		return ""
 	}
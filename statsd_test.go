@@ -18,6 +18,7 @@
 package appstats
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -172,11 +173,7 @@ func TestStatsDBucket_bucketKey(t *testing.T) {
 						return "bucket_key", true
 					},
 				},
-				bucket: &BucketInfo{
-					Tags: map[string][]string{
-						"a": {"b"},
-					},
-				},
+				bucket: new(bucketState).tag("a", "b"),
 			},
 			K: "bucket_key",
 		},
@@ -191,11 +188,7 @@ func TestStatsDBucket_bucketKey(t *testing.T) {
 						return "bucket_key", false
 					},
 				},
-				bucket: &BucketInfo{
-					Tags: map[string][]string{
-						"a": {"b"},
-					},
-				},
+				bucket: new(bucketState).tag("a", "b"),
 			},
 			K: "",
 		},
@@ -211,6 +204,24 @@ func TestStatsDBucket_bucketKey(t *testing.T) {
 	}
 }
 
+func TestStatsDService_Enabled(t *testing.T) {
+	if s := NewStatsDService(nil, nil); Enabled(s) || Enabled(s.Bucket("a")) {
+		t.Error("expected disabled")
+	}
+	if Enabled(statsDService{}) || Enabled(statsDBucket{}) {
+		t.Error("expected disabled")
+	}
+	s := NewStatsDService(mockStatsDClient{}, func(info BucketInfo) (string, bool) {
+		return info.Bucket, info.Bucket != "invalid"
+	})
+	if !Enabled(s) || !Enabled(s.Bucket("a")) || !Enabled(s.Bucket("a").Tag("b")) {
+		t.Error("expected enabled")
+	}
+	if Enabled(s.Bucket("invalid")) {
+		t.Error("expected disabled")
+	}
+}
+
 func TestStatsDService_Close(t *testing.T) {
 	var calls int
 	s := NewStatsDService(
@@ -253,6 +264,40 @@ func TestStatsDService_Flush(t *testing.T) {
 	}
 }
 
+type mockStatsDErrorClient struct {
+	mockStatsDClient
+	flushErr func() error
+	closeErr func() error
+}
+
+func (c mockStatsDErrorClient) FlushErr() error {
+	return c.flushErr()
+}
+
+func (c mockStatsDErrorClient) CloseErr() error {
+	return c.closeErr()
+}
+
+func TestStatsDService_errorClient(t *testing.T) {
+	s := NewStatsDService(
+		mockStatsDErrorClient{
+			flushErr: func() error {
+				return errors.New("flush_error")
+			},
+			closeErr: func() error {
+				return errors.New("close_error")
+			},
+		},
+		nil,
+	)
+	if err := s.Flush(); err == nil || err.Error() != "flush_error" {
+		t.Error("bad err", err)
+	}
+	if err := s.Close(); err == nil || err.Error() != "close_error" {
+		t.Error("bad err", err)
+	}
+}
+
 func TestStatsDBucket_Count(t *testing.T) {
 	var calls int
 	s := NewStatsDService(
@@ -0,0 +1,396 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dogStatsDBucketKeyFormat = bucketKeyFormat{
+	first:  "|#",
+	next:   ",",
+	assign: ":",
+}
+
+type (
+	// StatsDClientConfig configures a StatsDClient created by NewStatsDClient, note that only Address is required.
+	StatsDClientConfig struct {
+		// Network is one of "udp" (the default), "tcp", "unixgram", or "unix".
+		Network string
+		// Address is the address of the server, e.g. "localhost:8125", or the path of a unix socket, e.g.
+		// "/var/run/datadog/dsd.socket".
+		Address string
+		// Dial may be used to override net.Dial.
+		Dial func(network, address string) (net.Conn, error)
+		// MaxPacketSize is the max size of each packet (for datagrams), or write (for streams), though a single line
+		// that is larger will still be sent, it defaults to 1432 for udp, and 8192 otherwise.
+		MaxPacketSize int
+		// FlushInterval is how frequently buffered lines will be sent, it defaults to 100 milliseconds, and a
+		// negative value disables flushing in the background.
+		FlushInterval time.Duration
+		// WriteTimeout is the deadline for each write, it defaults to 1 second, which bounds how long a full unix
+		// socket buffer (e.g. if the agent is slow) may block.
+		WriteTimeout time.Duration
+		// ReconnectBackoff is the delay before re-dialing, after any error, which doubles for each consecutive
+		// error, up to MaxReconnectBackoff, it defaults to 100 milliseconds, and a negative value disables backoff.
+		ReconnectBackoff time.Duration
+		// MaxReconnectBackoff is the max delay before re-dialing, it defaults to 10 seconds.
+		MaxReconnectBackoff time.Duration
+		// MaxBufferSize is the max number of bytes that will be buffered, for streams ("tcp" and "unix"), while
+		// the connection is unavailable, after which the oldest lines will be dropped, it defaults to 1 MiB.
+		MaxBufferSize int
+		// Stats is an optional Bucket, which will be sent metrics about this client, distinguished by StatTag, where
+		// StatQueueDepth is the number of bytes buffered, which may be sent to a Service using this client.
+		Stats Bucket
+		// ErrorHandler will be called with any errors sending, or dropping data, if it is set, note that the data
+		// will be dropped, for datagrams, but kept in the buffer (up to MaxBufferSize), for streams, and that the
+		// errors will also be returned by the next FlushErr, see StatsDErrorClient.
+		ErrorHandler func(err error)
+	}
+
+	statsDClient struct {
+		config    StatsDClientConfig
+		stats     *selfStats
+		conn      *reconnectingConn
+		datagram  bool
+		mutex     sync.Mutex
+		buffer    []byte
+		err       error
+		errCount  int
+		closeOnce sync.Once
+		stop      chan struct{}
+		done      chan struct{}
+	}
+)
+
+// NewStatsDClient returns a first-party StatsDClient, which writes the StatsD line protocol, e.g. "bucket:1|c",
+// buffering lines into packets, and supports UDP, as well as unix datagram ("unixgram") and unix stream ("unix")
+// sockets, which are faster than UDP, and will report errors (e.g. a full buffer), rather than dropping packets
+// silently, e.g. for the Datadog agent, and TCP, for aggregators that support it. The connection is dialed lazily,
+// and re-dialed after any error (with exponential backoff), e.g. if the agent restarts, and re-creates the socket.
+//
+// For streams ("tcp" and "unix"), lines are newline terminated, and lines that failed to send are kept in the
+// buffer, and sent after reconnecting, up to MaxBufferSize, note that a line that was partially written when the
+// connection failed may be sent again, in full.
+//
+// Keys in the DogStatsD tagged form, generated by NewDogStatsDBucketKeyFunc, are supported, and will be written
+// like "bucket:1|c|#tag:value", while other keys are written as-is.
+// https://docs.datadoghq.com/developers/dogstatsd/unix_socket/
+//
+// The returned client also implements StatsDErrorClient, which NewStatsDService will use to return any errors.
+func NewStatsDClient(config StatsDClientConfig) StatsDClient {
+	if config.Network == "" {
+		config.Network = "udp"
+	}
+	if config.MaxPacketSize <= 0 {
+		if config.Network == "udp" {
+			config.MaxPacketSize = 1432
+		} else {
+			config.MaxPacketSize = 8192
+		}
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = time.Millisecond * 100
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = time.Second
+	}
+	if config.ReconnectBackoff == 0 {
+		config.ReconnectBackoff = time.Millisecond * 100
+	}
+	if config.MaxReconnectBackoff <= 0 {
+		config.MaxReconnectBackoff = time.Second * 10
+	}
+	if config.MaxBufferSize <= 0 {
+		config.MaxBufferSize = 1 << 20
+	}
+	if config.MaxBufferSize < config.MaxPacketSize {
+		config.MaxBufferSize = config.MaxPacketSize
+	}
+
+	c := &statsDClient{
+		config: config,
+		stats:  newSelfStats(config.Stats),
+		conn: &reconnectingConn{
+			network:      config.Network,
+			address:      config.Address,
+			dial:         config.Dial,
+			writeTimeout: config.WriteTimeout,
+			backoff:      config.ReconnectBackoff,
+			maxBackoff:   config.MaxReconnectBackoff,
+		},
+		datagram: strings.HasPrefix(config.Network, "udp") || config.Network == "unixgram",
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if config.FlushInterval > 0 {
+		go c.run()
+	} else {
+		close(c.done)
+	}
+
+	return c
+}
+
+// NewDogStatsDBucketKeyFunc returns a key func generating keys in the DogStatsD tagged form, like
+// "bucket|#tag1:a,tag2:b", using DatadogKeySanitisers, which is supported by NewStatsDClient, and
+// ParseDogStatsDBucketKey, note that the default TagValuesFunc is still TagValuesLast, but TagValuesAll is valid.
+func NewDogStatsDBucketKeyFunc(opts ...BucketKeyOption) BucketKeyFunc {
+	return newBucketKeyFunc(dogStatsDBucketKeyFormat, DatadogKeySanitisers(), opts...)
+}
+
+func (c *statsDClient) Close() {
+	_ = c.CloseErr()
+}
+
+// CloseErr stops flushing in the background, then flushes, and closes the connection, returning any error.
+func (c *statsDClient) CloseErr() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+	err := c.FlushErr()
+	if closeErr := c.conn.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("appstats.statsDClient.CloseErr close error: %s", closeErr.Error())
+	}
+	return err
+}
+
+func (c *statsDClient) Count(bucket string, n interface{}) {
+	c.send(bucket, fmt.Sprint(n), "c")
+}
+
+func (c *statsDClient) Flush() {
+	_ = c.FlushErr()
+}
+
+// FlushErr sends the buffered lines, returning the first error since the last call to Flush or FlushErr, if any,
+// including errors that occurred asynchronously (e.g. flushing in the background), note that it will also return
+// an error if the buffered lines were not sent, due to reconnect backoff.
+func (c *statsDClient) FlushErr() error {
+	backoff := c.flush() == errReconnectBackoff
+
+	c.mutex.Lock()
+	err, count := c.err, c.errCount
+	c.err, c.errCount = nil, 0
+	c.mutex.Unlock()
+
+	if err == nil && backoff {
+		return fmt.Errorf("appstats.statsDClient.FlushErr write error: %s", errReconnectBackoff.Error())
+	}
+
+	if count > 1 {
+		err = fmt.Errorf("%s (and %d more errors)", err.Error(), count-1)
+	}
+
+	return err
+}
+
+func (c *statsDClient) Gauge(bucket string, value interface{}) {
+	c.send(bucket, fmt.Sprint(value), "g")
+}
+
+func (c *statsDClient) Histogram(bucket string, value interface{}) {
+	c.send(bucket, fmt.Sprint(value), "h")
+}
+
+func (c *statsDClient) Increment(bucket string) {
+	c.send(bucket, "1", "c")
+}
+
+func (c *statsDClient) Timing(bucket string, value interface{}) {
+	c.send(bucket, fmt.Sprint(value), "ms")
+}
+
+func (c *statsDClient) Unique(bucket string, value string) {
+	c.send(bucket, value, "s")
+}
+
+func (c *statsDClient) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			_ = c.flush()
+		}
+	}
+}
+
+func (c *statsDClient) flush() error {
+	c.mutex.Lock()
+	packet := c.buffer
+	c.buffer = nil
+	c.mutex.Unlock()
+	if len(packet) == 0 {
+		return nil
+	}
+	defer c.stats.queue(c.buffered)
+	defer c.stats.flushed(timeNow())
+	return c.write(packet)
+}
+
+// buffered returns the number of bytes buffered.
+func (c *statsDClient) buffered() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.buffer)
+}
+
+// send buffers a line, first sending the buffered lines, if the line would not fit in the same packet, unless the
+// connection is backing off, in which case the buffer will be trimmed to MaxBufferSize.
+func (c *statsDClient) send(bucket, value, metricType string) {
+	line := formatStatsDLine(bucket, value, metricType)
+
+	c.mutex.Lock()
+	var (
+		packet  []byte
+		dropped []byte
+	)
+	if len(c.buffer) != 0 && len(c.buffer)+len(line) > c.config.MaxPacketSize {
+		if c.datagram || c.conn.ready() {
+			packet = c.buffer
+			c.buffer = nil
+		}
+	}
+	c.buffer = append(c.buffer, line...)
+	if !c.datagram {
+		dropped = c.trimLocked()
+	}
+	c.mutex.Unlock()
+
+	c.drop(dropped)
+
+	if packet != nil {
+		_ = c.write(packet)
+	}
+}
+
+// write sends a packet of newline terminated lines, note that the final newline is trimmed, for datagrams, and
+// that packets that fail to send are returned to the buffer, for streams. Any error will be handled, except
+// errReconnectBackoff, which is only returned.
+func (c *statsDClient) write(packet []byte) error {
+	if c.datagram {
+		err := c.conn.write(packet[:len(packet)-1])
+		if err != nil {
+			c.handleError(fmt.Errorf("appstats.statsDClient write error: %s", err.Error()))
+			c.stats.dropped(bytes.Count(packet, []byte{'\n'}))
+		} else {
+			c.stats.sent(bytes.Count(packet, []byte{'\n'}), len(packet)-1)
+		}
+		return err
+	}
+
+	err := c.conn.write(packet)
+	if err == nil {
+		c.stats.sent(bytes.Count(packet, []byte{'\n'}), len(packet))
+		return nil
+	}
+
+	if err != errReconnectBackoff {
+		c.handleError(fmt.Errorf("appstats.statsDClient write error: %s", err.Error()))
+	}
+
+	c.drop(c.requeue(packet))
+
+	return err
+}
+
+// requeue returns a packet to the front of the buffer, dropping the oldest lines if it exceeds MaxBufferSize,
+// returning the lines dropped.
+func (c *statsDClient) requeue(packet []byte) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	buffer := make([]byte, 0, len(packet)+len(c.buffer))
+	buffer = append(buffer, packet...)
+	c.buffer = append(buffer, c.buffer...)
+
+	return c.trimLocked()
+}
+
+// trimLocked drops the oldest lines from the buffer, until it fits within MaxBufferSize, returning the lines
+// dropped.
+func (c *statsDClient) trimLocked() []byte {
+	excess := len(c.buffer) - c.config.MaxBufferSize
+	if excess <= 0 {
+		return nil
+	}
+	n := len(c.buffer)
+	if i := bytes.IndexByte(c.buffer[excess-1:], '\n'); i >= 0 {
+		n = excess + i
+	}
+	dropped := c.buffer[:n:n]
+	c.buffer = c.buffer[n:]
+	if len(c.buffer) == 0 {
+		c.buffer = nil
+	}
+	return dropped
+}
+
+// drop handles lines dropped by trimLocked, if any.
+func (c *statsDClient) drop(lines []byte) {
+	if len(lines) == 0 {
+		return
+	}
+	c.handleError(fmt.Errorf("appstats.statsDClient buffer full: dropped %d bytes", len(lines)))
+	c.stats.dropped(bytes.Count(lines, []byte{'\n'}))
+}
+
+// handleError records err, to be returned by FlushErr, and passes it to ErrorHandler, if it is set.
+func (c *statsDClient) handleError(err error) {
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errCount++
+	c.mutex.Unlock()
+
+	c.stats.error()
+
+	if c.config.ErrorHandler != nil {
+		c.config.ErrorHandler(err)
+	}
+}
+
+// formatStatsDLine formats a newline terminated line, moving any DogStatsD tags to after the type.
+func formatStatsDLine(bucket, value, metricType string) []byte {
+	var tags string
+	if i := strings.Index(bucket, "|#"); i >= 0 {
+		bucket, tags = bucket[:i], bucket[i:]
+	}
+	var b bytes.Buffer
+	b.Grow(len(bucket) + len(value) + len(metricType) + len(tags) + 3)
+	b.WriteString(bucket)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(metricType)
+	b.WriteString(tags)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
@@ -0,0 +1,491 @@
+/*
+   Copyright 2018 Joseph Cumines
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package appstats
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// testSocketPath returns a path for a unix socket, in a temporary directory, which will be removed by the returned
+// func, note that it's kept short, as socket paths are limited to ~100 bytes.
+func testSocketPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "appstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "s.sock"), func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// readPackets reads n packets from conn, failing the test if it takes too long.
+func readPackets(t *testing.T, conn net.PacketConn, n int) []string {
+	t.Helper()
+	var packets []string
+	b := make([]byte, 65536)
+	for len(packets) < n {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+			t.Fatal(err)
+		}
+		size, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err, packets)
+		}
+		packets = append(packets, string(b[:size]))
+	}
+	return packets
+}
+
+func TestNewDogStatsDBucketKeyFunc(t *testing.T) {
+	testCases := []struct {
+		Info BucketInfo
+		Opts []BucketKeyOption
+		Key  string
+		Ok   bool
+	}{
+		{
+			Info: BucketInfo{},
+		},
+		{
+			Info: BucketInfo{Bucket: "Some.Bucket"},
+			Key:  "some.bucket",
+			Ok:   true,
+		},
+		{
+			Info: BucketInfo{
+				Bucket: "bucket",
+				Tags: map[string][]string{
+					"region": {"us-east-1", "us,west|2"},
+					"status": {"200"},
+				},
+			},
+			Opts: []BucketKeyOption{BucketKeyTagValues(TagValuesAll)},
+			Key:  "bucket|#region:us-east-1,region:us_west_2,status:200",
+			Ok:   true,
+		},
+	}
+	for i, testCase := range testCases {
+		name := fmt.Sprintf("TestNewDogStatsDBucketKeyFunc_#%d", i+1)
+
+		key, ok := NewDogStatsDBucketKeyFunc(testCase.Opts...)(testCase.Info)
+
+		if key != testCase.Key || ok != testCase.Ok {
+			t.Error(name, "expected =", testCase.Key, testCase.Ok, "actual =", key, ok)
+		}
+
+		if ok {
+			info, err := ParseDogStatsDBucketKey(key)
+			if err != nil || info.Bucket != key[:len(info.Bucket)] {
+				t.Error(name, "failed to parse", info, err)
+			}
+		}
+	}
+}
+
+func TestStatsDClient_udp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewStatsDClient(StatsDClientConfig{
+		Address:       conn.LocalAddr().String(),
+		FlushInterval: -1,
+	})
+
+	client.Count("a", 5)
+	client.Increment("a")
+	client.Gauge("b", 1.5)
+	client.Histogram("c|#k:v", 3)
+	client.Timing("d", 250)
+	client.Unique("e", "x")
+	client.Flush()
+
+	if diff := deep.Equal(
+		readPackets(t, conn, 1),
+		[]string{"a:5|c\na:1|c\nb:1.5|g\nc:3|h|#k:v\nd:250|ms\ne:x|s"},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	client.Close()
+}
+
+func TestStatsDClient_unixgram(t *testing.T) {
+	path, cleanup := testSocketPath(t)
+	defer cleanup()
+
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var (
+		mutex sync.Mutex
+		errs  []error
+	)
+	client := NewStatsDClient(StatsDClientConfig{
+		Network:       "unixgram",
+		Address:       path,
+		MaxPacketSize: 12,
+		FlushInterval: -1,
+		ErrorHandler: func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			errs = append(errs, err)
+		},
+	})
+
+	client.Increment("a")
+	client.Increment("b")
+	client.Increment("c")
+	client.Increment("some_long_bucket")
+	client.Close()
+
+	if diff := deep.Equal(
+		readPackets(t, conn, 3),
+		[]string{"a:1|c\nb:1|c", "c:1|c", "some_long_bucket:1|c"},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(errs) != 0 {
+		t.Error("unexpected errs", errs)
+	}
+}
+
+func TestStatsDClient_unixgramReconnect(t *testing.T) {
+	path, cleanup := testSocketPath(t)
+	defer cleanup()
+
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mutex sync.Mutex
+		errs  []error
+	)
+	client := NewStatsDClient(StatsDClientConfig{
+		Network:          "unixgram",
+		Address:          path,
+		FlushInterval:    -1,
+		ReconnectBackoff: -1,
+		ErrorHandler: func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	defer client.Close()
+
+	client.Increment("a")
+	client.Flush()
+	readPackets(t, conn, 1)
+
+	// simulates the agent restarting
+	conn.Close()
+	_ = os.Remove(path)
+
+	client.Increment("b")
+	client.Flush()
+
+	mutex.Lock()
+	if len(errs) != 1 {
+		t.Error("unexpected errs", errs)
+	}
+	mutex.Unlock()
+
+	conn, err = net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client.Increment("c")
+	client.Flush()
+
+	if diff := deep.Equal(readPackets(t, conn, 1), []string{"c:1|c"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestStatsDClient_unix(t *testing.T) {
+	path, cleanup := testSocketPath(t)
+	defer cleanup()
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	lines := make(chan string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	client := NewStatsDClient(StatsDClientConfig{
+		Network:       "unix",
+		Address:       path,
+		FlushInterval: time.Millisecond,
+	})
+	defer client.Close()
+
+	client.Increment("a|#k:v")
+	client.Gauge("b", -1)
+
+	var actual []string
+	for len(actual) < 2 {
+		select {
+		case line := <-lines:
+			actual = append(actual, line)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out", actual)
+		}
+	}
+
+	if diff := deep.Equal(actual, []string{"a:1|c|#k:v", "b:-1|g"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// newTestStreamListener accepts connections, sending each line received to the returned channel, until closed.
+func newTestStreamListener(t *testing.T, network, address string) (net.Listener, <-chan string) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 64)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return listener, lines
+}
+
+// readLines reads n lines, failing the test if it takes too long.
+func readLines(t *testing.T, lines <-chan string, n int) []string {
+	t.Helper()
+	var actual []string
+	for len(actual) < n {
+		select {
+		case line := <-lines:
+			actual = append(actual, line)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out", actual)
+		}
+	}
+	return actual
+}
+
+func TestStatsDClient_tcp(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	listener, lines := newTestStreamListener(t, "tcp", "127.0.0.1:0")
+	defer listener.Close()
+
+	var (
+		mutex sync.Mutex
+		errs  []string
+		dials int
+	)
+	stats, samples := newTestStatsBucket()
+	client := NewStatsDClient(StatsDClientConfig{
+		Stats:            stats,
+		Network:          "tcp",
+		Address:          listener.Addr().String(),
+		MaxPacketSize:    12,
+		FlushInterval:    -1,
+		ReconnectBackoff: time.Second,
+		MaxBufferSize:    12,
+		Dial: func(network, address string) (net.Conn, error) {
+			dials++
+			if dials == 1 {
+				return nil, errors.New("some_error")
+			}
+			return net.Dial(network, address)
+		},
+		ErrorHandler: func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			errs = append(errs, err.Error())
+		},
+	})
+	defer client.Close()
+
+	client.Increment("a")
+	client.Flush()
+
+	// backing off, the buffer is kept, but trimmed
+	client.Increment("b")
+	client.Increment("c")
+	client.Flush()
+
+	if dials != 1 {
+		t.Error("unexpected dials", dials)
+	}
+
+	stubTimeNow(time.Unix(101, 0))
+
+	client.Increment("d|#k:v")
+	client.Flush()
+
+	if diff := deep.Equal(readLines(t, lines, 3), []string{"b:1|c", "c:1|c", "d:1|c|#k:v"}); diff != nil {
+		t.Error(diff)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if diff := deep.Equal(
+		errs,
+		[]string{
+			"appstats.statsDClient write error: some_error",
+			"appstats.statsDClient buffer full: dropped 6 bytes",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+
+	if diff := deep.Equal(
+		samples(),
+		[]string{
+			"stats,stat=errors count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 6",
+			"stats,stat=errors count 1",
+			"stats,stat=drops count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 12",
+			"stats,stat=lines count 2",
+			"stats,stat=bytes count 12",
+			"stats,stat=packets count 1",
+			"stats,stat=lines count 1",
+			"stats,stat=bytes count 11",
+			"stats,stat=packets count 1",
+			"stats,stat=flush_latency timing 0s",
+			"stats,stat=queue_depth gauge 0",
+		},
+	); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestStatsDClient_FlushErr(t *testing.T) {
+	defer stubTimeNow(time.Unix(100, 0))()
+
+	var dials int
+	client := NewStatsDClient(StatsDClientConfig{
+		Network:          "tcp",
+		MaxPacketSize:    6,
+		FlushInterval:    -1,
+		ReconnectBackoff: time.Second,
+		Dial: func(network, address string) (net.Conn, error) {
+			dials++
+			return nil, fmt.Errorf("error_%d", dials)
+		},
+	}).(StatsDErrorClient)
+
+	if err := client.FlushErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Increment("a")
+	if err := client.FlushErr(); err == nil || err.Error() != "appstats.statsDClient write error: error_1" {
+		t.Fatal(err)
+	}
+
+	// the lines are still buffered, but not sent
+	if err := client.FlushErr(); err == nil || err.Error() != "appstats.statsDClient.FlushErr write error: appstats.reconnectingConn reconnect backoff" {
+		t.Fatal(err)
+	}
+
+	// sends the buffered line, asynchronously
+	stubTimeNow(time.Unix(101, 0))
+	client.Increment("b")
+	stubTimeNow(time.Unix(103, 0))
+
+	if err := client.CloseErr(); err == nil || err.Error() != "appstats.statsDClient write error: error_2 (and 1 more errors)" {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsDClient_service(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := NewStatsDService(
+		NewStatsDClient(StatsDClientConfig{
+			Address:       conn.LocalAddr().String(),
+			FlushInterval: -1,
+		}),
+		NewDogStatsDBucketKeyFunc(),
+	)
+
+	s.Bucket("requests").Tag("status", 200).Increment()
+	s.Bucket("users").Unique("a b")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(
+		readPackets(t, conn, 1),
+		[]string{"requests:1|c|#status:200\nusers:\"a b\"|s"},
+	); diff != nil {
+		t.Error(diff)
+	}
+}